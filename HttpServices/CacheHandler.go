@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// implements cache administration service handler:
+// GET returns the cache counters, POST/DELETE with prefix parameter purges the entries which key starts with prefix.
+// thumbnail cache keys start with the normalized source url, source cache keys are the normalized source url
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// disk cache counters
+type diskCacheStats struct {
+	Entries int `json:"entries"`
+	Size int64 `json:"size"`
+	MaxSize int64 `json:"maxsize"`
+}
+
+// cache service stats response
+type cacheStatsResponse struct {
+	Memory *memoryCacheStats `json:"memory"` // null when disabled
+	Disk *diskCacheStats `json:"disk"` // null when disabled
+	Source *diskCacheStats `json:"source"` // null when disabled
+}
+
+// cache service purge response
+type cachePurgeResponse struct {
+	Memory int `json:"memory"` // purged memory entries
+	Disk int `json:"disk"` // purged disk entries
+	Source int `json:"source"` // purged source images
+}
+
+// disk cache counters, nil when disabled
+func newDiskCacheStats(cache *diskCache) *diskCacheStats {
+	if cache == nil {
+		return nil
+	}
+
+	entries, size := cache.Stats()
+	return &diskCacheStats{Entries: entries, Size: size, MaxSize: cache.maxSize}
+}
+
+// registration function
+func registerCacheAdmin(config *CommonServiceConfig) error {
+	if err := validateAdminConfig(config); err != nil {
+		return err
+	}
+
+	http.HandleFunc(config.Path, func(w http.ResponseWriter, r *http.Request) {
+		cacheAdminHandler(w, r, config)
+	})
+	return nil
+}
+
+// cache service handler
+func cacheAdminHandler(w http.ResponseWriter, r *http.Request, config *CommonServiceConfig) {
+	if isAdminAuthorized(w, r, config) == false {
+		return
+	}
+
+	var response interface{}
+
+	switch r.Method {
+	case http.MethodGet:
+		stats := cacheStatsResponse{}
+		if gServiceManager.memoryCache != nil {
+			memoryStats := gServiceManager.memoryCache.Stats()
+			stats.Memory = &memoryStats
+		}
+		stats.Disk = newDiskCacheStats(gServiceManager.diskCache)
+		stats.Source = newDiskCacheStats(gServiceManager.sourceCache)
+		response = stats
+
+	case http.MethodPost, http.MethodDelete:
+		values := r.URL.Query()
+		if _, ok := values["prefix"]; ok == false {
+			writeError(w, r, newServiceError(errorBadRequest, errors.New("prefix not found")))
+			return
+		}
+
+		// empty prefix purges all the entries
+		purged := cachePurgeResponse{}
+		purged.Memory, purged.Disk, purged.Source = gServiceManager.cachePurge(values.Get("prefix"))
+		response = purged
+
+	default:
+		writeError(w, r, newServiceError(errorMethodNotAllowed, errors.New("method Not allowed")))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -19,15 +19,20 @@ package HttpServices
 // common tools for services
 
 import (
-	"fmt"
 	"strings"
 
 	"errors"
+	"log"
 	"net/http"
 	"os"
 	"io"
 	"image"
 	"image/jpeg"
+	"bytes"
+	"net/url"
+	"path"
+	"time"
+	"crypto/subtle"
 )
 
 // service registration function type
@@ -36,18 +41,95 @@ type registerService func(*CommonServiceConfig) error
 // common services configuration
 type CommonServiceConfig struct {
 	Path string `yaml:"path"`
+	Background string `yaml:"background"` // default padding background, hex color or "blur"
+	Filter string `yaml:"filter"` // default resampling filter
+	MaxDpr float64 `yaml:"maxdpr"` // maximum device pixel ratio, default 3
+	DprUpscale bool `yaml:"dprupscale"` // device pixel ratio may make thumbnails bigger than the source
+	Upscale string `yaml:"upscale"` // default upscaling policy, never, always or pad-only
+	MaxSourcePixels int64 `yaml:"maxsourcepixels"` // maximum source image pixels (width * height), default 100 megapixels
+	MaxOutputWidth int `yaml:"maxoutputwidth"` // maximum thumbnail width, default 8192
+	MaxOutputHeight int `yaml:"maxoutputheight"` // maximum thumbnail height, default 8192
+	MaxOutputPixels int64 `yaml:"maxoutputpixels"` // maximum thumbnail pixels (width * height), default 40 megapixels
+	Format string `yaml:"format"` // default output format, auto or empty for the source format
+	SourceFormats []string `yaml:"sourceformats"` // allowed source image formats, empty allows all supported
+	CheckExtension bool `yaml:"checkextension"` // require a supported image extension in the source url
+	Quality int `yaml:"quality"` // default jpeg quality, 1-100
+	Progressive bool `yaml:"progressive"` // default progressive jpeg encoding
+	Chroma string `yaml:"chroma"` // default jpeg chroma subsampling, 420 or 444
+	KeepMeta bool `yaml:"keepmeta"` // default keep source copyright metadata (artist, copyright) in jpeg thumbnails
+	AllowHosts []string `yaml:"allowhosts"` // permitted source hosts, exact or wildcard (*.example.com). empty permits all
+	DenyHosts []string `yaml:"denyhosts"` // refused source hosts, exact or wildcard
+	Origins map[string]OriginConfig `yaml:"origins"` // named origins, requested by src and path
+	MaxAge int `yaml:"maxage"` // thumbnail responses Cache-Control max-age in seconds, no Cache-Control when 0
+	Immutable bool `yaml:"immutable"` // add immutable to the thumbnail responses Cache-Control
+	Token string `yaml:"token"` // admin services token, required in the X-Admin-Token header when set
 }
 
 // service manager configuration
 type ServiceManagerConfig struct {
 	Port string `yaml:"port"`
 	TempPath string `yaml:"tmppath"`
+	SpoolThreshold int64 `yaml:"spoolthreshold"` // downloads bigger than this (bytes) are spooled to tmppath
+	Cache CacheConfig `yaml:"cache"` // rendered thumbnails cache
+	Fetch FetchConfig `yaml:"fetch"` // source images download
+	Workers int `yaml:"workers"` // concurrent decode / resize limit, default the number of cpus
+	QueueSize int `yaml:"queuesize"` // requests waiting for a worker, default 4 per worker
+	QueueTimeout int `yaml:"queuetimeout"` // maximum wait for a worker in milliseconds, default 5000
+	PixelBudget int64 `yaml:"pixelbudget"` // source pixels decoded at once by all requests, default 400 megapixels
 	Services map[string]CommonServiceConfig `yaml:"services"`
 }
 
-// convert error to json
-func errorStringToJson(str string) string{
-	return fmt.Sprintf("{\"error\": \"%s\"}", str)
+// rendered thumbnails cache configuration
+type CacheConfig struct {
+	Path string `yaml:"path"` // disk cache directory, empty disables the disk cache
+	MaxSize int64 `yaml:"maxsize"` // disk cache maximum size in bytes
+	JanitorInterval int `yaml:"janitorinterval"` // seconds between disk cache janitor runs
+	MemorySize int64 `yaml:"memorysize"` // memory cache budget in MB, 0 disables the memory cache
+	SourcePath string `yaml:"sourcepath"` // source images cache directory, empty disables the source cache
+	SourceMaxSize int64 `yaml:"sourcemaxsize"` // source images cache maximum size in bytes
+}
+
+// named source origin configuration
+type OriginConfig struct {
+	Url string `yaml:"url"` // base url, the requested path is appended
+	Headers map[string]string `yaml:"headers"` // headers sent to the origin
+	Username string `yaml:"username"` // basic authentication user
+	Password string `yaml:"password"` // basic authentication password
+}
+
+// source images download configuration
+type FetchConfig struct {
+	AllowNetworks []string `yaml:"allownetworks"` // addresses / cidrs allowed even when blocked by default (private, loopback, ...)
+	DenyNetworks []string `yaml:"denynetworks"` // addresses / cidrs always refused
+	ConnectTimeout int `yaml:"connecttimeout"` // connect timeout in milliseconds, default 10000
+	ReadTimeout int `yaml:"readtimeout"` // maximum wait for data in milliseconds, default 30000
+	Timeout int `yaml:"timeout"` // whole download timeout in milliseconds, default 60000
+	MaxSize int64 `yaml:"maxsize"` // maximum download size in bytes, default 50MB
+	MaxRedirects int `yaml:"maxredirects"` // maximum redirects, default 10. -1 follows none
+	CheckContentType bool `yaml:"checkcontenttype"` // refuse responses which content type is not an image
+}
+
+// validate admin service configuration: a path and a token, admin services are never open
+func validateAdminConfig(config *CommonServiceConfig) error {
+	if config.Path == "" {
+		return errors.New("path Not valid")
+	}
+
+	if config.Token == "" {
+		log.Print("token not found, required by admin services")
+		return errors.New("token not found, required by admin services")
+	}
+	return nil
+}
+
+// check the admin service token, unauthorized requests are answered.
+// without a configured token all requests are refused
+func isAdminAuthorized(w http.ResponseWriter, r *http.Request, config *CommonServiceConfig) bool {
+	if config.Token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(config.Token)) != 1 {
+		writeError(w, r, newServiceError(errorUnauthorized, errors.New("token Not valid")))
+		return false
+	}
+	return true
 }
 
 // extract and validate file name from url
@@ -66,9 +148,55 @@ func extractFileNameFromUrl(url string) (string, error) {
 	return fileName, nil
 }
 
+// extract file name from url, the extension is validated only when required.
+// without extension validation any url is accepted, and the file name is sanitized
+func fileNameFromUrl(rawUrl string, checkExtension bool) (string, error) {
+	if checkExtension {
+		return extractFileNameFromUrl(rawUrl)
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", errors.New("url not valid")
+	}
+
+	// keep only safe characters, the name is used for temporary files
+	fileName := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return -1
+	}, path.Base(u.Path))
+
+	if strings.Trim(fileName, ".") == "" {
+		fileName = "image"
+	}
+
+	return fileName, nil
+}
+
+// normalize url for comparison: lower case scheme and host, no default port,
+// sorted query parameters and no fragment
+func normalizeUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) || (u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+
+	return u.String()
+}
+
 // is file type valid/supported
 func isImageFileTypeValid(fileType string) bool {
-	for _, fType := range []string{"jpeg", "jpg"} {
+	for _, fType := range []string{"jpeg", "jpg", "png", "gif", "bmp", "tif", "tiff", "webp"} {
 		if strings.ToLower(fileType) == fType {
 			return  true
 		}
@@ -81,29 +209,112 @@ func registerImageFormats() {
 	image.RegisterFormat("jpeg", "jpg", jpeg.Decode, jpeg.DecodeConfig)
 }
 
-// download file and save it
-func downloadFile(url string, filePath string) error {
+// downloaded source, in memory, spooled to a temporary file or read from the source cache
+type sourceData struct {
+	io.ReadSeeker
+	file *os.File // spool file, nil when in memory
+	cacheFile *os.File // source cache file, nil when not cached
+	lastModified time.Time // origin Last-Modified, zero when unknown
+}
+
+// release the source, the spool file is deleted
+func (p *sourceData) Close() error {
+	if p.cacheFile != nil {
+		p.cacheFile.Close()
+	}
 
-	// Create the file
-	out, err := os.Create(filePath)
+	if p.file == nil {
+		return nil
+	}
+
+	p.file.Close()
+	return os.Remove(p.file.Name())
+}
+
+// download source and keep it in memory. bigger than threshold, it is spooled to spoolPath
+func downloadSource(source *sourceRequest, spoolPath string, threshold int64) (*sourceData, error) {
+	req, err := source.newRequest()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer out.Close()
 
 	// Get the data
-	resp, err := http.Get(url)
+	resp, err := gServiceManager.fetcher.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	// save to local file
-	_, err = io.Copy(out, resp.Body)
+	if err := gServiceManager.fetcher.checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	src, err := readSource(resp.Body, spoolPath, threshold)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
\ No newline at end of file
+	src.lastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return src, nil
+}
+
+// read source and keep it in memory. bigger than threshold, it is spooled to spoolPath
+func readSource(r io.Reader, spoolPath string, threshold int64) (*sourceData, error) {
+	// read up to the threshold in memory
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, threshold+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n <= threshold {
+		return &sourceData{ReadSeeker: bytes.NewReader(buf.Bytes())}, nil
+	}
+
+	// spool to file
+	out, err := os.Create(spoolPath)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &sourceData{ReadSeeker: out, file: out}
+	if _, err = io.Copy(out, io.MultiReader(&buf, r)); err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	if _, err = out.Seek(0, io.SeekStart); err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	return src, nil
+}
+
+// clamp value into [min, max]
+func clampInt(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// smaller of two values
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// bigger of two values
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,442 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// persistent disk cache of rendered thumbnails.
+// entries are content addressed (sha256 of the cache key), written atomically (temporary file + rename),
+// and evicted in least recently used order when the cache is bigger than its maximum size.
+// a background janitor removes leftovers of interrupted writes and keeps the index in sync with the disk.
+// files which are not cache entries are never touched, the directory may hold other files
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix of files being written
+const diskCacheTmpPrefix = ".thumbnail-cache-tmp-"
+
+// default janitor interval
+const diskCacheDefaultJanitorInterval = time.Minute
+
+// cached thumbnail: response headers and encoded image
+type cacheEntry struct {
+	header http.Header
+	data []byte
+}
+
+// disk cache file header, first line of the file
+type diskCacheMeta struct {
+	Key string `json:"key"`
+	Header http.Header `json:"header"`
+}
+
+// disk cache index item
+type diskCacheItem struct {
+	name string // file name, hash of the key
+	key string // cache key
+	size int64 // file size
+	seq uint64 // add sequence, items added while syncing are not in the directory listing
+}
+
+// disk cache, safe for concurrent use
+type diskCache struct {
+	path string // cache directory
+	maxSize int64 // maximum total size of the files
+	mutex sync.Mutex // index guard
+	size int64 // total size of the files
+	lru *list.List // index items, most recently used first
+	items map[string]*list.Element // index items by file name
+	seq uint64 // last add sequence
+	stop chan struct{} // janitor stop
+}
+
+// create disk cache in path, existing entries are loaded
+func newDiskCache(path string, maxSize int64) (*diskCache, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("Cache max size not valid")
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	p := &diskCache{path: path, maxSize: maxSize, lru: list.New(), items: make(map[string]*list.Element)}
+	if err := p.sync(0); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// file name of the key
+func diskCacheName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// is file name a cache entry name (hex sha256)
+func isDiskCacheName(name string) bool {
+	if len(name) != sha256.Size * 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// get entry of key, nil when not cached
+func (p *diskCache) Get(key string) *cacheEntry {
+	name := diskCacheName(key)
+	if p.touch(name) == false {
+		return nil
+	}
+
+	entry, err := p.read(name)
+	if err != nil {
+		p.remove(name)
+		return nil
+	}
+
+	return entry
+}
+
+// open entry of key, the data is read from the returned section of the file.
+// the file must be closed by the caller, nil when not cached
+func (p *diskCache) Open(key string) (http.Header, *io.SectionReader, *os.File) {
+	name := diskCacheName(key)
+	if p.touch(name) == false {
+		return nil, nil, nil
+	}
+
+	meta, fp, offset, err := p.openFile(name)
+	if err != nil {
+		p.remove(name)
+		return nil, nil, nil
+	}
+
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, nil, nil
+	}
+
+	return meta.Header, io.NewSectionReader(fp, offset, info.Size() - offset), fp
+}
+
+// mark entry as most recently used, false when not cached
+func (p *diskCache) touch(name string) bool {
+	p.mutex.Lock()
+	element, ok := p.items[name]
+	if ok {
+		p.lru.MoveToFront(element)
+	}
+	p.mutex.Unlock()
+
+	if ok {
+		// keep the use order after restart
+		now := time.Now()
+		os.Chtimes(filepath.Join(p.path, name), now, now)
+	}
+
+	return ok
+}
+
+// put entry of key, written to a temporary file and renamed
+func (p *diskCache) Put(key string, entry *cacheEntry) error {
+	return p.PutReader(key, entry.header, bytes.NewReader(entry.data))
+}
+
+// put entry of key with the data read from r, written to a temporary file and renamed
+func (p *diskCache) PutReader(key string, header http.Header, r io.Reader) error {
+	meta, err := json.Marshal(diskCacheMeta{Key: key, Header: header})
+	if err != nil {
+		return err
+	}
+
+	if int64(len(meta) + 1) > p.maxSize {
+		return errors.New("Cache entry too big")
+	}
+
+	fp, err := ioutil.TempFile(p.path, diskCacheTmpPrefix)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fp)
+	w.Write(meta)
+	w.WriteByte('\n')
+
+	// one byte more than the space left detects entries bigger than the cache
+	n, err := io.CopyN(w, r, p.maxSize - int64(len(meta)))
+	if err == io.EOF {
+		err = w.Flush()
+	} else if err == nil {
+		err = errors.New("Cache entry too big")
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+
+	name := diskCacheName(key)
+	if err == nil {
+		err = os.Rename(fp.Name(), filepath.Join(p.path, name))
+	}
+
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.add(name, key, int64(len(meta)) + 1 + n, true)
+	p.evict()
+	return nil
+}
+
+// remove entries which key starts with prefix, returns the number of removed entries
+func (p *diskCache) Purge(prefix string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	count := 0
+	for name, element := range p.items {
+		if strings.HasPrefix(element.Value.(*diskCacheItem).key, prefix) {
+			p.removeLocked(name)
+			count++
+		}
+	}
+	return count
+}
+
+// number of entries and total size
+func (p *diskCache) Stats() (int, int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.items), p.size
+}
+
+// read entry file
+func (p *diskCache) read(name string) (*cacheEntry, error) {
+	b, err := ioutil.ReadFile(filepath.Join(p.path, name))
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, errors.New("Cache entry not valid")
+	}
+
+	var meta diskCacheMeta
+	if err := json.Unmarshal(b[:i], &meta); err != nil {
+		return nil, err
+	}
+
+	return &cacheEntry{header: meta.Header, data: b[i+1:]}, nil
+}
+
+// open entry file, returns the file header and the data offset
+func (p *diskCache) openFile(name string) (*diskCacheMeta, *os.File, int64, error) {
+	fp, err := os.Open(filepath.Join(p.path, name))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	line, err := bufio.NewReader(fp).ReadBytes('\n')
+	if err != nil {
+		fp.Close()
+		return nil, nil, 0, err
+	}
+
+	var meta diskCacheMeta
+	if err := json.Unmarshal(line, &meta); err != nil {
+		fp.Close()
+		return nil, nil, 0, err
+	}
+
+	return &meta, fp, int64(len(line)), nil
+}
+
+// read key of entry file
+func (p *diskCache) readKey(name string) (string, error) {
+	meta, fp, _, err := p.openFile(name)
+	if err != nil {
+		return "", err
+	}
+	fp.Close()
+
+	return meta.Key, nil
+}
+
+// add or update index item, as most or least recently used. mutex must be locked
+func (p *diskCache) add(name string, key string, size int64, recent bool) {
+	p.seq++
+	if element, ok := p.items[name]; ok {
+		item := element.Value.(*diskCacheItem)
+		p.size += size - item.size
+		item.size = size
+		item.seq = p.seq
+		if recent {
+			p.lru.MoveToFront(element)
+		}
+		return
+	}
+
+	item := &diskCacheItem{name: name, key: key, size: size, seq: p.seq}
+	if recent {
+		p.items[name] = p.lru.PushFront(item)
+	} else {
+		p.items[name] = p.lru.PushBack(item)
+	}
+	p.size += size
+}
+
+// remove entry file and index item
+func (p *diskCache) remove(name string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.removeLocked(name)
+}
+
+// remove entry file and index item. mutex must be locked
+func (p *diskCache) removeLocked(name string) {
+	if element, ok := p.items[name]; ok {
+		p.size -= element.Value.(*diskCacheItem).size
+		p.lru.Remove(element)
+		delete(p.items, name)
+	}
+	os.Remove(filepath.Join(p.path, name))
+}
+
+// remove least recently used entries until the cache fits its maximum size. mutex must be locked
+func (p *diskCache) evict() {
+	for p.size > p.maxSize && p.lru.Len() > 0 {
+		p.removeLocked(p.lru.Back().Value.(*diskCacheItem).name)
+	}
+}
+
+// sync index with the files in the cache directory, temporary files older than tmpAge are removed
+func (p *diskCache) sync(tmpAge time.Duration) error {
+	p.mutex.Lock()
+	listSeq := p.seq
+	p.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(p.path)
+	if err != nil {
+		return err
+	}
+
+	// most recently used (modified) first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	found := make(map[string]bool)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		if strings.HasPrefix(file.Name(), diskCacheTmpPrefix) {
+			if time.Since(file.ModTime()) >= tmpAge {
+				os.Remove(filepath.Join(p.path, file.Name())) // interrupted write
+			}
+			continue
+		}
+
+		if isDiskCacheName(file.Name()) == false {
+			continue // not a cache entry, left alone
+		}
+
+		found[file.Name()] = true
+		if _, ok := p.items[file.Name()]; ok {
+			continue
+		}
+
+		// new file, created before restart or by another process
+		key, err := p.readKey(file.Name())
+		if err != nil || diskCacheName(key) != file.Name() {
+			log.Println("Cache file not valid, skipped: ", filepath.Join(p.path, file.Name()))
+			continue
+		}
+		p.add(file.Name(), key, file.Size(), false)
+	}
+
+	// entries deleted from the disk, entries added after the listing are kept
+	for name, element := range p.items {
+		if found[name] == false && element.Value.(*diskCacheItem).seq <= listSeq {
+			p.removeLocked(name)
+		}
+	}
+
+	p.evict()
+	return nil
+}
+
+// start background janitor
+func (p *diskCache) startJanitor(interval time.Duration) {
+	if interval <= 0 {
+		interval = diskCacheDefaultJanitorInterval
+	}
+
+	p.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.sync(interval); err != nil {
+					log.Println("Cache janitor error: ", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop)
+}
+
+// stop background janitor
+func (p *diskCache) stopJanitor() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
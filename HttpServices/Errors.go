@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// typed service errors: every error answered to the client has a kind, mapped to the http status
+// and to a stable error code. errors are answered with a json body:
+// {"code": "...", "message": "...", "request_id": "...", "details": {...}}
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// maximum length of a client request id
+const requestIdMaxLength = 128
+
+// error kinds
+type errorKind int
+
+const (
+	errorInternal errorKind = iota // unexpected failure, 500
+	errorBadRequest // request parameters not valid, 400
+	errorUpstreamNotFound // source not found at the origin, 404
+	errorUpstream // origin unreachable or failed, 502
+	errorUpstreamTimeout // origin too slow, 504
+	errorUnsupportedFormat // source is not a supported image, 415
+	errorTooLarge // source too large, 413
+	errorUnprocessable // source image not valid, 422
+	errorBusy // server saturated, 503
+	errorUnauthorized // admin token not valid, 401
+	errorMethodNotAllowed // method not supported by the service, 405
+)
+
+// error codes of the error kinds, clients switch on these (documented in README.md)
+var errorKindCode = map[errorKind]string{
+	errorInternal: "internal_error",
+	errorBadRequest: "bad_request",
+	errorUpstreamNotFound: "upstream_not_found",
+	errorUpstream: "upstream_error",
+	errorUpstreamTimeout: "upstream_timeout",
+	errorUnsupportedFormat: "unsupported_format",
+	errorTooLarge: "too_large",
+	errorUnprocessable: "unprocessable_image",
+	errorBusy: "busy",
+	errorUnauthorized: "unauthorized",
+	errorMethodNotAllowed: "method_not_allowed",
+}
+
+// http status of the error kinds
+var errorKindStatus = map[errorKind]int{
+	errorInternal: http.StatusInternalServerError,
+	errorBadRequest: http.StatusBadRequest,
+	errorUpstreamNotFound: http.StatusNotFound,
+	errorUpstream: http.StatusBadGateway,
+	errorUpstreamTimeout: http.StatusGatewayTimeout,
+	errorUnsupportedFormat: http.StatusUnsupportedMediaType,
+	errorTooLarge: http.StatusRequestEntityTooLarge,
+	errorUnprocessable: http.StatusUnprocessableEntity,
+	errorBusy: http.StatusServiceUnavailable,
+	errorUnauthorized: http.StatusUnauthorized,
+	errorMethodNotAllowed: http.StatusMethodNotAllowed,
+}
+
+// json error response
+type errorResponse struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+	RequestId string `json:"request_id"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// error of a kind, the message is the message of the cause
+type serviceError struct {
+	kind errorKind
+	err error // cause
+	details map[string]interface{} // optional details of the response
+}
+
+// create error of kind, nil when err is nil
+func newServiceError(kind errorKind, err error) error {
+	return newServiceErrorDetails(kind, err, nil)
+}
+
+// create error of kind with response details, nil when err is nil
+func newServiceErrorDetails(kind errorKind, err error, details map[string]interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &serviceError{kind: kind, err: err, details: details}
+}
+
+func (p *serviceError) Error() string {
+	return p.err.Error()
+}
+
+// kind of the error, errors without kind are internal
+func errorKindOf(err error) errorKind {
+	if e, ok := err.(*serviceError); ok {
+		return e.kind
+	}
+	return errorInternal
+}
+
+// http status of the error
+func errorStatus(err error) int {
+	return errorKindStatus[errorKindOf(err)]
+}
+
+// response details of the error, nil when none
+func errorDetails(err error) map[string]interface{} {
+	if e, ok := err.(*serviceError); ok {
+		return e.details
+	}
+	return nil
+}
+
+// answer the error as json, with the status of its kind
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	kind := errorKindOf(err)
+	res := errorResponse{Code: errorKindCode[kind], Message: err.Error(), RequestId: requestId(w, r), Details: errorDetails(err)}
+	log.Printf("Request %s error: %s %s", res.RequestId, res.Code, res.Message)
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(errorKindStatus[kind])
+	json.NewEncoder(w).Encode(res)
+}
+
+// request id of the X-Request-Id header, generated when missing or not valid.
+// the id is sent back in the X-Request-Id response header
+func requestId(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if isRequestIdValid(id) == false {
+		id = newRequestId()
+	}
+	w.Header().Set("X-Request-Id", id)
+	return id
+}
+
+// is client request id valid: letters, digits and "-_.:" only, not longer than requestIdMaxLength
+func isRequestIdValid(id string) bool {
+	if id == "" || len(id) > requestIdMaxLength {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' && r != '.' && r != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// random request id
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// classify download error: limits, refused destinations, timeouts, and other origin failures
+func fetchError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*serviceError); ok {
+		return err
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return newServiceError(errorUpstreamTimeout, err)
+	}
+
+	switch rootError(err) {
+	case errSourceTooLarge:
+		return newServiceError(errorTooLarge, err)
+	case errFetchBlocked, errFetchScheme, errFetchHostNotAllowed:
+		return newServiceError(errorBadRequest, err)
+	}
+
+	return newServiceError(errorUpstream, err)
+}
+
+// cause of url and network errors
+func rootError(err error) error {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *serviceError:
+			err = e.err
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// minimal exif support: orientation correction, and copyright fields kept on request.
+// thumbnails are always re-encoded, so any other metadata (gps, camera, ...) is dropped.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"github.com/disintegration/imaging"
+)
+
+// exif tags in use
+const (
+	exifTagOrientation = 0x0112
+	exifTagArtist = 0x013b
+	exifTagCopyright = 0x8298
+)
+
+// exif value types in use
+const (
+	exifTypeAscii = 2
+	exifTypeShort = 3
+	exifTypeLong = 4
+)
+
+// exif header of the jpeg app1 segment
+var exifHeader = []byte("Exif\x00\x00")
+
+// metadata read from the source image
+type exifData struct {
+	orientation int // 1-8, 0 when unknown
+	artist string
+	copyright string
+}
+
+// single exif entry, for writing
+type exifEntry struct {
+	tag uint16
+	valueType uint16 // ascii, short or long
+	value interface{} // string, uint16 or uint32 by type
+}
+
+// read exif data of a jpeg image. images without exif have empty data
+func readExif(r io.Reader) (*exifData, error) {
+	data := &exifData{}
+
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return nil, errors.New("Not a jpeg image")
+	}
+
+	// walk the segments until the image data
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return data, nil
+		}
+
+		if header[0] != 0xff || header[1] == 0xda || header[1] == 0xd9 {
+			return data, nil // start of scan / end of image, no exif
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return data, nil
+		}
+
+		if header[1] != 0xe1 {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length)); err != nil {
+				return data, nil
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return data, nil
+		}
+
+		if bytes.HasPrefix(segment, exifHeader) {
+			parseExif(segment[len(exifHeader):], data)
+			return data, nil
+		}
+	}
+}
+
+// parse the tiff structure of the exif segment, only the first ifd is read
+func parseExif(tiff []byte, data *exifData) {
+	if len(tiff) < 8 {
+		return
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return
+		}
+
+		tag := order.Uint16(tiff[entry:])
+		valueType := order.Uint16(tiff[entry+2:])
+		valueCount := int(order.Uint32(tiff[entry+4:]))
+
+		switch {
+		case tag == exifTagOrientation && valueType == exifTypeShort:
+			data.orientation = int(order.Uint16(tiff[entry+8:]))
+		case (tag == exifTagArtist || tag == exifTagCopyright) && valueType == exifTypeAscii:
+			value := tiff[entry+8 : entry+12]
+			if valueCount > 4 {
+				valueOffset := int(order.Uint32(tiff[entry+8:]))
+				if valueOffset < 0 || valueCount > len(tiff) || valueOffset > len(tiff)-valueCount {
+					continue
+				}
+				value = tiff[valueOffset : valueOffset+valueCount]
+			} else if valueCount >= 0 {
+				value = value[:valueCount]
+			}
+
+			text := string(bytes.TrimRight(value, "\x00"))
+			if tag == exifTagArtist {
+				data.artist = text
+			} else {
+				data.copyright = text
+			}
+		}
+	}
+}
+
+// transform the image so it is displayed upright, by exif orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// build jpeg app1 exif segment (with marker) of the entries, entries must be sorted by tag.
+// nil when the entries are too big for a segment
+func buildExifSegment(entries []exifEntry) []byte {
+	order := binary.BigEndian
+
+	// tiff header, a single ifd right after it
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	ifd := make([]byte, 2, 2+len(entries)*12+4)
+	order.PutUint16(ifd, uint16(len(entries)))
+	values := []byte{}
+	valuesOffset := len(tiff) + cap(ifd)
+
+	for _, entry := range entries {
+		var field [12]byte
+		order.PutUint16(field[0:], entry.tag)
+		order.PutUint16(field[2:], entry.valueType)
+
+		switch entry.valueType {
+		case exifTypeAscii:
+			text := append([]byte(entry.value.(string)), 0)
+			order.PutUint32(field[4:], uint32(len(text)))
+			if len(text) <= 4 {
+				copy(field[8:], text)
+			} else {
+				order.PutUint32(field[8:], uint32(valuesOffset+len(values)))
+				values = append(values, text...)
+				if len(values)%2 == 1 {
+					values = append(values, 0) // keep offsets word aligned
+				}
+			}
+		case exifTypeShort:
+			order.PutUint32(field[4:], 1)
+			order.PutUint16(field[8:], entry.value.(uint16))
+		case exifTypeLong:
+			order.PutUint32(field[4:], 1)
+			order.PutUint32(field[8:], entry.value.(uint32))
+		}
+
+		ifd = append(ifd, field[:]...)
+	}
+	ifd = append(ifd, 0, 0, 0, 0) // no next ifd
+
+	payload := append(append(append(append([]byte{}, exifHeader...), tiff...), ifd...), values...)
+	if len(payload)+2 > 0xffff {
+		return nil // does not fit in a segment
+	}
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	order.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// copyright entries of the exif data, to be kept in the thumbnail
+func (p *exifData) copyrightEntries() []exifEntry {
+	entries := []exifEntry{}
+	if p.artist != "" {
+		entries = append(entries, exifEntry{exifTagArtist, exifTypeAscii, p.artist})
+	}
+	if p.copyright != "" {
+		entries = append(entries, exifEntry{exifTagCopyright, exifTypeAscii, p.copyright})
+	}
+	return entries
+}
+
+// insert exif segment right after the start of image marker of the jpeg data
+func insertExifSegment(jpegData []byte, segment []byte) []byte {
+	return append(append(append([]byte{}, jpegData[:2]...), segment...), jpegData[2:]...)
+}
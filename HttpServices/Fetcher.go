@@ -0,0 +1,357 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// source images fetcher, protects against server side request forgery:
+// only http(s) urls are fetched, and connections to private, loopback, link-local and multicast
+// addresses are refused. the address is checked when connecting, after the host is resolved,
+// so redirects and dns changes can't reach a blocked destination.
+// downloads are limited in time (connect, read and total timeouts), size and redirects
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// download limits defaults
+const (
+	fetchDefaultMaxRedirects = 10
+	fetchDefaultConnectTimeout = 10 * time.Second
+	fetchDefaultReadTimeout = 30 * time.Second
+	fetchDefaultTimeout = 60 * time.Second
+	fetchDefaultMaxSize = 50 << 20 // 50MB
+)
+
+// destinations blocked by default
+var fetchBlockedNetworks = parseNetworksMust([]string{
+	"0.0.0.0/8", // this network
+	"10.0.0.0/8", // private
+	"100.64.0.0/10", // carrier grade nat
+	"127.0.0.0/8", // loopback
+	"169.254.0.0/16", // link-local, cloud metadata
+	"172.16.0.0/12", // private
+	"192.0.0.0/24", // protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15", // benchmarking
+	"224.0.0.0/4", // multicast
+	"240.0.0.0/4", // reserved, broadcast
+	"::/128", // unspecified
+	"::1/128", // loopback
+	"fc00::/7", // unique local
+	"fe80::/10", // link-local
+	"ff00::/8", // multicast
+})
+
+// ipv6 networks embedding an ipv4 address, the ipv4 address is checked too
+var (
+	fetchNat64Network = parseNetworksMust([]string{"64:ff9b::/96"})[0] // nat64, ipv4 in the last 4 bytes
+	fetch6to4Network = parseNetworksMust([]string{"2002::/16"})[0] // 6to4, ipv4 in bytes 2-5
+	fetchCompatNetwork = parseNetworksMust([]string{"::/96"})[0] // ipv4 compatible (deprecated), ipv4 in the last 4 bytes
+)
+
+// destination refused
+var errFetchBlocked = errors.New("Destination not allowed")
+
+// scheme refused
+var errFetchScheme = errors.New("Url scheme not allowed")
+
+// download bigger than the maximum size
+var errSourceTooLarge = errors.New("Source too large")
+
+// too many redirects
+var errFetchRedirects = errors.New("Too many redirects")
+
+// source images fetcher
+type sourceFetcher struct {
+	client *http.Client
+	allowNetworks []*net.IPNet // allowed even when blocked by default
+	denyNetworks []*net.IPNet // always refused
+	maxSize int64 // maximum download size
+	maxRedirects int // maximum redirects, 0 follows none
+	checkContentType bool // refuse responses which content type is not an image
+}
+
+// create fetcher of the fetch configuration
+func newSourceFetcher(config FetchConfig) (*sourceFetcher, error) {
+	if config.ConnectTimeout < 0 || config.ReadTimeout < 0 || config.Timeout < 0 || config.MaxSize < 0 || config.MaxRedirects < -1 {
+		return nil, errors.New("fetch limits Not valid")
+	}
+
+	p := &sourceFetcher{maxSize: config.MaxSize, maxRedirects: config.MaxRedirects, checkContentType: config.CheckContentType}
+	if p.maxSize == 0 {
+		p.maxSize = fetchDefaultMaxSize
+	}
+	switch p.maxRedirects {
+	case 0:
+		p.maxRedirects = fetchDefaultMaxRedirects
+	case -1:
+		p.maxRedirects = 0
+	}
+
+	var err error
+	if p.allowNetworks, err = parseNetworks(config.AllowNetworks); err != nil {
+		return nil, err
+	}
+	if p.denyNetworks, err = parseNetworks(config.DenyNetworks); err != nil {
+		return nil, err
+	}
+
+	readTimeout := fetchTimeout(config.ReadTimeout, fetchDefaultReadTimeout)
+	dialer := &net.Dialer{Timeout: fetchTimeout(config.ConnectTimeout, fetchDefaultConnectTimeout), KeepAlive: 30 * time.Second, Control: p.control}
+	transport := &http.Transport{
+		Proxy: nil, // a proxy would connect to the destination on our behalf
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return &deadlineConn{Conn: conn, timeout: readTimeout}, nil
+		},
+		MaxIdleConns: 100,
+		IdleConnTimeout: 90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	p.client = &http.Client{Transport: transport, CheckRedirect: p.checkRedirect, Timeout: fetchTimeout(config.Timeout, fetchDefaultTimeout)}
+	return p, nil
+}
+
+// configured timeout in milliseconds, or the default
+func fetchTimeout(milliseconds int, defaultTimeout time.Duration) time.Duration {
+	if milliseconds == 0 {
+		return defaultTimeout
+	}
+	return time.Duration(milliseconds) * time.Millisecond
+}
+
+// connection which waits for data up to the read timeout
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// read, with a deadline renewed on every read
+func (p *deadlineConn) Read(b []byte) (int, error) {
+	if err := p.Conn.SetReadDeadline(time.Now().Add(p.timeout)); err != nil {
+		return 0, err
+	}
+	return p.Conn.Read(b)
+}
+
+// response body which refuses to read more than the maximum size
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// read, errSourceTooLarge once the maximum size is exceeded
+func (p *limitedBody) Read(b []byte) (int, error) {
+	if p.remaining < 0 {
+		return 0, errSourceTooLarge
+	}
+
+	// one byte more than the remaining detects the overflow
+	if int64(len(b)) > p.remaining + 1 {
+		b = b[:p.remaining + 1]
+	}
+
+	n, err := p.ReadCloser.Read(b)
+	p.remaining -= int64(n)
+	if p.remaining < 0 {
+		return n, errSourceTooLarge
+	}
+	return n, err
+}
+
+// check response of a download: status must be 2xx, and the content type an image when checked
+func (p *sourceFetcher) checkResponse(resp *http.Response) error {
+	details := map[string]interface{}{"upstream_status": resp.StatusCode}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return newServiceErrorDetails(errorUpstreamNotFound, errors.New("Source response status " + strconv.Itoa(resp.StatusCode)), details)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newServiceErrorDetails(errorUpstream, errors.New("Source response status " + strconv.Itoa(resp.StatusCode)), details)
+	}
+
+	if p.checkContentType && isImageContentType(resp.Header.Get("Content-Type")) == false {
+		return newServiceError(errorUnsupportedFormat, errors.New("Source content type " + resp.Header.Get("Content-Type") + " not supported"))
+	}
+
+	return nil
+}
+
+// is content type of an image, generic binary types are accepted
+func isImageContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == ""
+	}
+
+	return strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream"
+}
+
+// send request, only http(s) urls of permitted hosts are fetched
+func (p *sourceFetcher) Do(req *http.Request) (*http.Response, error) {
+	if isFetchSchemeAllowed(req.URL.Scheme) == false {
+		return nil, errFetchScheme
+	}
+	if err := requestHostPolicy(req).check(req.URL); err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// declared size, the body is limited while reading too
+	if resp.ContentLength > p.maxSize {
+		resp.Body.Close()
+		return nil, errSourceTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: p.maxSize}
+
+	return resp, nil
+}
+
+// get url
+func (p *sourceFetcher) Get(rawUrl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.Do(req)
+}
+
+// check every redirect, the destination address is checked when connecting
+func (p *sourceFetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.maxRedirects {
+		return errFetchRedirects
+	}
+	if isFetchSchemeAllowed(req.URL.Scheme) == false {
+		return errFetchScheme
+	}
+	return requestHostPolicy(req).check(req.URL)
+}
+
+// dialer control, refuse blocked addresses before connecting
+func (p *sourceFetcher) control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || p.isBlocked(ip) {
+		return errFetchBlocked
+	}
+	return nil
+}
+
+// is ip refused: denied, or blocked by default and not allowed.
+// ipv6 addresses embedding an ipv4 address are refused when either address is refused
+func (p *sourceFetcher) isBlocked(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4 // ipv4 mapped ipv6 addresses are checked as ipv4
+	} else if ip4 := embeddedIPv4(ip); ip4 != nil && p.isBlockedAddress(ip4) {
+		return true
+	}
+
+	return p.isBlockedAddress(ip)
+}
+
+// is address refused by the deny, allow and default lists
+func (p *sourceFetcher) isBlockedAddress(ip net.IP) bool {
+	if containsIP(p.denyNetworks, ip) {
+		return true
+	}
+	if containsIP(p.allowNetworks, ip) {
+		return false
+	}
+	return containsIP(fetchBlockedNetworks, ip)
+}
+
+// ipv4 address embedded in a nat64, 6to4 or ipv4 compatible address, nil when none
+func embeddedIPv4(ip net.IP) net.IP {
+	ip = ip.To16()
+	switch {
+	case ip == nil:
+		return nil
+	case fetchNat64Network.Contains(ip):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+	case fetch6to4Network.Contains(ip):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4()
+	case fetchCompatNetwork.Contains(ip) && ip[12] != 0:
+		// :: and ::1 are ipv6 addresses, not ipv4 compatible
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+	}
+	return nil
+}
+
+// is scheme fetched
+func isFetchSchemeAllowed(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// is ip in one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse cidr list, single addresses are accepted too
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.New("network " + value + " Not valid")
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parse constant cidr list
+func parseNetworksMust(values []string) []*net.IPNet {
+	networks, err := parseNetworks(values)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
@@ -19,6 +19,27 @@ package HttpServices
 import (
 	"testing"
 	"net/url"
+	"image"
+	"image/color"
+	"github.com/disintegration/imaging"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"bytes"
+	"image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"strconv"
+	"sync/atomic"
+	"encoding/json"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"errors"
+	"strings"
+	"time"
 )
 
 func TestLoadConfiguration(t *testing.T) {
@@ -77,7 +98,7 @@ func TestFillThumbnailParams(t *testing.T) {
 	values["height"] = append(values["height"],"200")
 
 	// valid case
-	params, err := fillThumbnailParams(values)
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
 	if err != nil {
 		t.Error("value are valid, should be parsed")
 	}
@@ -88,14 +109,14 @@ func TestFillThumbnailParams(t *testing.T) {
 
 	// not valid
 	values["width"][0] = "www"
-	params, err = fillThumbnailParams(values)
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
 	if err == nil {
 		t.Error("Type is not numeric, function should return error")
 	}
 
 	values["width"][0] = "100"
 	values["height"][0] = "www"
-	params, err = fillThumbnailParams(values)
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
 	if err == nil {
 		t.Error("Type is not numeric, function should return error")
 	}
@@ -103,31 +124,112 @@ func TestFillThumbnailParams(t *testing.T) {
 	values["width"][0] = "100"
 	values["height"][0] = "100"
 	values["url"][0] = ""
-	params, err = fillThumbnailParams(values)
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
 	if err == nil {
 		t.Error("value empty, function should return error")
 	}
 
 	values["url"][0] = "http://www.example.com/image.jpg"
 	delete(values,"width")
-	params, err = fillThumbnailParams(values)
-	if err == nil {
-		t.Error("value empty, function should return error")
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.width != 0 || params.height != 100 {
+		t.Error("width is optional, value should be parsed")
 	}
 
 	delete(values,"height")
-	params, err = fillThumbnailParams(values)
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
 	if err == nil {
 		t.Error("value empty, function should return error")
 	}
 
 	delete(values,"url")
-	params, err = fillThumbnailParams(values)
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
 	if err == nil {
 		t.Error("value empty, function should return error")
 	}
 }
 
+func TestFillThumbnailParamsFit(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+
+	// default fit mode
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.fit != fitPad {
+		t.Error("fit mode should default to pad")
+	}
+
+	for _, fit := range []string{"pad", "cover", "fill", "inside", "COVER"} {
+		values.Set("fit", fit)
+		if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err != nil {
+			t.Error("valid fit mode should be parsed: " + fit)
+		}
+	}
+
+	values.Set("fit", "crop")
+	if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+		t.Error("not valid fit mode should not be parsed")
+	}
+}
+
+// create a solid image for the transformation tests
+func newTestImage(width int, height int) image.Image {
+	return imaging.New(width, height, color.NRGBA{255, 0, 0, 255})
+}
+
+func TestThumbnailTransformFit(t *testing.T) {
+	srcImg := newTestImage(400, 200)
+
+	// wide source into a square box
+	expected := map[string]image.Point{
+		fitPad: image.Pt(100, 100),
+		fitCover: image.Pt(100, 100),
+		fitFill: image.Pt(100, 100),
+		fitInside: image.Pt(100, 50),
+	}
+
+	for fit, size := range expected {
+		params := &thumbnailParameters{width: 100, height: 100, fit: fit}
+		if res := thumbnailTransform(srcImg, params).Bounds().Size(); res != size {
+			t.Errorf("fit %s: size %v, expected %v", fit, res, size)
+		}
+	}
+
+	// padding is transparent, image is centered
+	params := &thumbnailParameters{width: 100, height: 100, fit: fitPad}
+	dstImg := thumbnailTransform(srcImg, params)
+	if _, _, _, a := dstImg.At(50, 10).RGBA(); a != 0 {
+		t.Error("pad area should be transparent")
+	}
+	if r, _, _, _ := dstImg.At(50, 50).RGBA(); r == 0 {
+		t.Error("image should be placed in the center")
+	}
+
+	// cover crops, no padding
+	params.fit = fitCover
+	dstImg = thumbnailTransform(srcImg, params)
+	if _, _, _, a := dstImg.At(50, 0).RGBA(); a == 0 {
+		t.Error("cover should not leave padding")
+	}
+}
+
+func TestThumbnailHandlerCoverThinSource(t *testing.T) {
+	initTestManager(t)
+
+	// sources smaller than 100 pixels covering a big size, no huge intermediate image
+	for _, size := range []image.Point{image.Pt(1, 300), image.Pt(300, 1), image.Pt(1, 1)} {
+		server := newTestImageServer(newTestImage(size.X, size.Y), imaging.PNG)
+		w := requestThumbnail("url=" + url.QueryEscape(server.URL) + "&fit=cover&width=2000&height=2000", "", &CommonServiceConfig{})
+		server.Close()
+
+		if img, _, err := image.DecodeConfig(w.Body); w.Code != http.StatusOK || err != nil || img.Width != 2000 || img.Height != 2000 {
+			t.Errorf("%dx%d source should be covered to 2000x2000, got %d", size.X, size.Y, w.Code)
+		}
+	}
+}
+
 func TestCommonExtractFileNameFromUrl(t *testing.T) {
 
 	// valid cases
@@ -195,7 +297,7 @@ func TestCommonExtractFileNameFromUrl(t *testing.T) {
 		t.Error("url not valid should not be parsed")
 	}
 
-	res, err = extractFileNameFromUrl("http://www.example.com/image.bmp")
+	res, err = extractFileNameFromUrl("http://www.example.com/image.svg")
 	if err == nil {
 		t.Error("none valid file type should not be parsed")
 	}
@@ -256,14 +358,3391 @@ func TestCommonIsImageFileTypeValid(t *testing.T) {
 		t.Error("not valid type should not be parsed")
 	}
 
-	if res := isImageFileTypeValid("bmp"); res == true {
+	if res := isImageFileTypeValid("svg"); res == true {
 		t.Error("not valid type should not be parsed")
 	}
 
-	if res := isImageFileTypeValid("BMP"); res == true {
+	if res := isImageFileTypeValid("SVG"); res == true {
 		t.Error("not valid type should not be parsed")
 	}
+
+	// other source formats
+	for _, fileType := range []string{"png", "gif", "bmp", "BMP", "tif", "tiff", "webp"} {
+		if res := isImageFileTypeValid(fileType); res != true {
+			t.Error("valid type should be parsed: " + fileType)
+		}
+	}
+}
+
+func TestCommonFileNameFromUrl(t *testing.T) {
+	// extension not required
+	expected := map[string]string{
+		"http://www.example.com/image.jpg": "image.jpg",
+		"http://www.example.com/img/123?w=800": "123",
+		"http://www.example.com/img/123.png?w=800#top": "123.png",
+		"http://www.example.com/": "image",
+		"http://www.example.com": "image",
+		"http://www.example.com/..": "image",
+		"http://www.example.com/a%2F..%2Fb%20c.jpg": "bc.jpg",
+		"http://www.example.com/image.svg": "image.svg",
+	}
+
+	for rawUrl, fileName := range expected {
+		if res, err := fileNameFromUrl(rawUrl, false); err != nil || res != fileName {
+			t.Errorf("url %s: file name %q, expected %q", rawUrl, res, fileName)
+		}
+	}
+
+	if _, err := fileNameFromUrl("http://www.example.com/%zz", false); err == nil {
+		t.Error("url not valid should not be parsed")
+	}
+
+	// extension required
+	if res, err := fileNameFromUrl("http://www.example.com/image.png", true); err != nil || res != "image.png" {
+		t.Error("Valid url file name should be parsed")
+	}
+
+	if _, err := fileNameFromUrl("http://www.example.com/img/123?w=800", true); err == nil {
+		t.Error("url without extension should not be parsed")
+	}
+}
+
+func TestIsSourceFormatAllowed(t *testing.T) {
+	for _, format := range []string{"jpeg", "png", "gif", "bmp", "tiff", "webp"} {
+		if isSourceFormatAllowed(format, nil) == false {
+			t.Error("supported format should be allowed: " + format)
+		}
+	}
+
+	if isSourceFormatAllowed("svg", nil) {
+		t.Error("not supported format should not be allowed")
+	}
+
+	allowed := []string{"JPG", "png"}
+	if isSourceFormatAllowed("jpeg", allowed) == false || isSourceFormatAllowed("png", allowed) == false {
+		t.Error("listed format should be allowed")
+	}
+
+	if isSourceFormatAllowed("gif", allowed) {
+		t.Error("not listed format should not be allowed")
+	}
+}
+
+
+
+
+func TestFillThumbnailParamsGravity(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+
+	// default gravity
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.gravity != "center" {
+		t.Error("gravity should default to center")
+	}
+
+	for _, gravity := range []string{"center", "north", "south", "east", "west", "northeast", "northwest", "southeast", "SouthWest"} {
+		values.Set("gravity", gravity)
+		if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err != nil {
+			t.Error("valid gravity should be parsed: " + gravity)
+		}
+	}
+
+	values.Set("gravity", "top")
+	if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+		t.Error("not valid gravity should not be parsed")
+	}
+}
+
+func TestThumbnailTransformGravity(t *testing.T) {
+	// tall source, padded left/right
+	params := &thumbnailParameters{width: 100, height: 100, fit: fitPad, gravity: "west"}
+	dstImg := thumbnailTransform(newTestImage(200, 400), params)
+	if _, _, _, a := dstImg.At(10, 50).RGBA(); a == 0 {
+		t.Error("west gravity should place the image on the left")
+	}
+	if _, _, _, a := dstImg.At(90, 50).RGBA(); a != 0 {
+		t.Error("west gravity should pad on the right")
+	}
+
+	// wide source, padded top/bottom
+	params.gravity = "south"
+	dstImg = thumbnailTransform(newTestImage(400, 200), params)
+	if _, _, _, a := dstImg.At(50, 90).RGBA(); a == 0 {
+		t.Error("south gravity should place the image at the bottom")
+	}
+	if _, _, _, a := dstImg.At(50, 10).RGBA(); a != 0 {
+		t.Error("south gravity should pad at the top")
+	}
+
+	// left half red, right half blue, cropped into a square
+	srcImg := imaging.Paste(newTestImage(400, 200), imaging.New(200, 200, color.NRGBA{0, 0, 255, 255}), image.Pt(200, 0))
+	params.fit = fitCover
+
+	params.gravity = "west"
+	if r, _, b, _ := thumbnailTransform(srcImg, params).At(90, 50).RGBA(); r == 0 || b != 0 {
+		t.Error("west gravity should keep the left side")
+	}
+
+	params.gravity = "east"
+	if r, _, b, _ := thumbnailTransform(srcImg, params).At(10, 50).RGBA(); r != 0 || b == 0 {
+		t.Error("east gravity should keep the right side")
+	}
+}
+
+func TestAnchorPoint(t *testing.T) {
+	expected := map[imaging.Anchor]image.Point{
+		imaging.Center: image.Pt(40, 20),
+		imaging.Top: image.Pt(40, 0),
+		imaging.Bottom: image.Pt(40, 40),
+		imaging.Left: image.Pt(0, 20),
+		imaging.Right: image.Pt(80, 20),
+		imaging.TopLeft: image.Pt(0, 0),
+		imaging.TopRight: image.Pt(80, 0),
+		imaging.BottomLeft: image.Pt(0, 40),
+		imaging.BottomRight: image.Pt(80, 40),
+	}
+
+	for anchor, pt := range expected {
+		if res := anchorPoint(100, 60, 20, 20, anchor); res != pt {
+			t.Errorf("anchor %d: point %v, expected %v", anchor, res, pt)
+		}
+	}
+}
+
+// create a gray image with a detailed checkerboard region
+func newTestDetailImage(width int, height int, detail image.Rectangle) image.Image {
+	img := imaging.New(width, height, color.NRGBA{128, 128, 128, 255})
+	for y := detail.Min.Y; y < detail.Max.Y; y++ {
+		for x := detail.Min.X; x < detail.Max.X; x++ {
+			if (x/8 + y/8) % 2 == 0 {
+				img.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+			} else {
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestSmartCropRect(t *testing.T) {
+	// detail on the right side
+	srcImg := newTestDetailImage(400, 200, image.Rect(320, 40, 400, 160))
+	if rect := smartCropRect(srcImg, 100, 100); rect != image.Rect(200, 0, 400, 200) {
+		t.Errorf("crop should keep the right side, got %v", rect)
+	}
+
+	// detail on the top
+	detail := image.Rect(100, 20, 200, 200)
+	srcImg = newTestDetailImage(300, 900, detail)
+	if rect := smartCropRect(srcImg, 100, 100); rect.Size() != image.Pt(300, 300) || detail.In(rect) == false {
+		t.Errorf("crop should keep the top, got %v", rect)
+	}
+
+	// skin tone region on the left, no edges
+	srcImg = imaging.Paste(imaging.New(400, 200, color.NRGBA{128, 128, 128, 255}), imaging.New(60, 60, color.NRGBA{220, 170, 140, 255}), image.Pt(20, 70))
+	if rect := smartCropRect(srcImg, 100, 100); rect.Min.X > 20 {
+		t.Errorf("crop should keep the skin tone region, got %v", rect)
+	}
+
+	// flat image falls back to the center
+	srcImg = newTestImage(400, 200)
+	if rect := smartCropRect(srcImg, 100, 100); rect != image.Rect(100, 0, 300, 200) {
+		t.Errorf("flat image should be cropped in the center, got %v", rect)
+	}
+}
+
+func TestThumbnailTransformSmart(t *testing.T) {
+	srcImg := newTestDetailImage(400, 200, image.Rect(320, 40, 400, 160))
+
+	params := &thumbnailParameters{width: 100, height: 100, fit: fitCover, gravity: gravitySmart}
+	dstImg := thumbnailTransform(srcImg, params)
+	if dstImg.Bounds().Size() != image.Pt(100, 100) {
+		t.Error("smart crop size not as expected")
+	}
+
+	// the checkerboard is on the right side of the thumbnail
+	if r, g, b, _ := dstImg.At(10, 50).RGBA(); r != g || g != b || r>>8 != 128 {
+		t.Error("smart crop should keep the detailed region")
+	}
+	if r, _, _, _ := dstImg.At(90, 50).RGBA(); r>>8 == 128 {
+		t.Error("smart crop should keep the detailed region")
+	}
+
+	// smart gravity is parsed
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+	values.Set("gravity", "smart")
+	if params, err := fillThumbnailParams(values, &CommonServiceConfig{}); err != nil || params.gravity != gravitySmart {
+		t.Error("smart gravity should be parsed")
+	}
+}
+
+func TestParseBackground(t *testing.T) {
+	expected := map[string]color.NRGBA{
+		"ffffff": {255, 255, 255, 255},
+		"#FF0000": {255, 0, 0, 255},
+		"00ff0080": {0, 255, 0, 128},
+		"#00f": {0, 0, 255, 255},
+		"0f08": {0, 255, 0, 136},
+		"00000000": {0, 0, 0, 0},
+	}
+
+	for value, c := range expected {
+		res, blur, err := parseBackground(value)
+		if err != nil || blur || res != c {
+			t.Errorf("background %s: color %v, expected %v", value, res, c)
+		}
+	}
+
+	if _, blur, err := parseBackground("BLUR"); err != nil || blur == false {
+		t.Error("blur background should be parsed")
+	}
+
+	for _, value := range []string{"", "#", "ff", "fffff", "fffffffff", "gggggg", "+fffff", "red"} {
+		if _, _, err := parseBackground(value); err == nil {
+			t.Error("not valid background should not be parsed: " + value)
+		}
+	}
+}
+
+func TestFillThumbnailParamsBackground(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+
+	// default is transparent
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.background != (color.NRGBA{}) || params.blurBackground {
+		t.Error("background should default to transparent")
+	}
+
+	// service default
+	config := &CommonServiceConfig{Background: "blur"}
+	params, err = fillThumbnailParams(values, config)
+	if err != nil || params.blurBackground == false {
+		t.Error("background should be taken from the service configuration")
+	}
+
+	// parameter overrides the service default
+	values.Set("bg", "ffffff")
+	params, err = fillThumbnailParams(values, config)
+	if err != nil || params.blurBackground || params.background != (color.NRGBA{255, 255, 255, 255}) {
+		t.Error("bg parameter should override the service configuration")
+	}
+
+	values.Set("bg", "white")
+	if _, err := fillThumbnailParams(values, config); err == nil {
+		t.Error("not valid bg should not be parsed")
+	}
+
+	// not valid service default
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_bg", Background: "white"}); err == nil {
+		t.Error("not valid service background should not be registered")
+	}
+}
+
+func TestThumbnailTransformBackground(t *testing.T) {
+	// wide source, padded top/bottom
+	params := &thumbnailParameters{width: 100, height: 100, fit: fitPad, background: color.NRGBA{255, 255, 255, 255}}
+	dstImg := thumbnailTransform(newTestImage(400, 200), params)
+	if r, g, b, a := dstImg.At(50, 5).RGBA(); r>>8 != 255 || g>>8 != 255 || b>>8 != 255 || a>>8 != 255 {
+		t.Error("pad area should be filled with the background color")
+	}
+
+	// blurred copy of the image, in the pad area
+	params.blurBackground = true
+	dstImg = thumbnailTransform(newTestImage(400, 200), params)
+	if r, g, _, a := dstImg.At(50, 5).RGBA(); r>>8 < 200 || g>>8 > 50 || a>>8 != 255 {
+		t.Error("pad area should be filled with the blurred image")
+	}
+}
+
+func TestThumbnailHandlerBlurThinSource(t *testing.T) {
+	initTestManager(t)
+
+	// thin sources and a big canvas: no huge intermediate image, and no blur at the canvas size
+	for _, size := range []image.Point{image.Pt(1, 300), image.Pt(300, 1)} {
+		server := newTestImageServer(newTestImage(size.X, size.Y), imaging.PNG)
+		start := time.Now()
+		w := requestThumbnail("url=" + url.QueryEscape(server.URL) + "&bg=blur&width=2000&height=2000&format=png", "", &CommonServiceConfig{})
+		server.Close()
+
+		if img, _, err := image.DecodeConfig(w.Body); w.Code != http.StatusOK || err != nil || img.Width != 2000 || img.Height != 2000 {
+			t.Errorf("%dx%d source should be padded to 2000x2000, got %d", size.X, size.Y, w.Code)
+		}
+		if elapsed := time.Since(start); elapsed > 5 * time.Second {
+			t.Errorf("%dx%d source blur took %v", size.X, size.Y, elapsed)
+		}
+	}
+}
+
+func TestFillThumbnailParamsFormat(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+
+	// default is the source format
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.format != formatSource {
+		t.Error("format should default to the source format")
+	}
+
+	// service default
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{Format: "auto"})
+	if err != nil || params.format != formatAuto {
+		t.Error("format should be taken from the service configuration")
+	}
+
+	expected := map[string]string{"jpeg": "jpeg", "JPG": "jpeg", "png": "png", "gif": "gif", "auto": "auto"}
+	for value, format := range expected {
+		values.Set("format", value)
+		if params, err := fillThumbnailParams(values, &CommonServiceConfig{}); err != nil || params.format != format {
+			t.Error("valid format should be parsed: " + value)
+		}
+	}
+
+	for _, value := range []string{"webp", "bmp", "xxx"} {
+		values.Set("format", value)
+		if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+			t.Error("not valid format should not be parsed: " + value)
+		}
+	}
+
+	// not valid service default
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_format", Format: "webp"}); err == nil {
+		t.Error("not available service format should not be registered")
+	}
+}
+
+func TestIsContentTypeAccepted(t *testing.T) {
+	accepted := map[string]bool{
+		"": true,
+		"image/png": true,
+		"image/*": true,
+		"*/*": true,
+		"text/html, image/png;q=0.5": true,
+		"image/webp,image/*;q=0.8": true,
+		"image/png;q=0": false,
+		"image/*, image/png;q=0": false,
+		"*/*, image/png;q=0": false,
+		"image/jpeg": false,
+		"text/html": false,
+		"image/*;q=0, image/png": true,
+	}
+
+	for accept, res := range accepted {
+		if isContentTypeAccepted(accept, "image/png") != res {
+			t.Errorf("accept %q: expected %v", accept, res)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	opaqueImg := newTestImage(10, 10)
+	alphaImg := imaging.New(10, 10, color.NRGBA{255, 0, 0, 128})
+
+	if res := negotiateFormat("", opaqueImg); res != "jpeg" {
+		t.Error("opaque image should be jpeg, got " + res)
+	}
+
+	if res := negotiateFormat("", alphaImg); res != "png" {
+		t.Error("transparent image should be png, got " + res)
+	}
+
+	if res := negotiateFormat("image/gif, image/jpeg", alphaImg); res != "gif" {
+		t.Error("transparent image should be gif when png not accepted, got " + res)
+	}
+
+	if res := negotiateFormat("image/png", opaqueImg); res != "png" {
+		t.Error("opaque image should be png when jpeg not accepted, got " + res)
+	}
+
+	if res := negotiateFormat("text/html", alphaImg); res != "jpeg" {
+		t.Error("nothing accepted should fallback to jpeg, got " + res)
+	}
+}
+
+// make sure the service manager exists, downloads are saved to the system temporary path
+func initTestManager(t *testing.T) {
+	if gServiceManager == nil {
+		if err := newManager(); err != nil {
+			t.Fatal("Cannot create manager")
+		}
+	}
+	gServiceManager.config.TempPath = os.TempDir()
+
+	// test servers listen on loopback
+	fetcher, err := newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.0/8", "::1"}})
+	if err != nil {
+		t.Fatal("Cannot create fetcher")
+	}
+	gServiceManager.fetcher = fetcher
+}
+
+// serve the image encoded in the given format
+func newTestImageServer(img image.Image, format imaging.Format) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		imaging.Encode(w, img, format)
+	}))
+}
+
+// serve the image encoded in the given format, count the requests
+func newTestCountingServer(img image.Image, format imaging.Format, count *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(count, 1)
+		imaging.Encode(w, img, format)
+	}))
+}
+
+// serve data with the given headers, revalidated by If-None-Match / If-Modified-Since.
+// requests counts all the requests, downloads only the full responses
+func newTestRevalidationServer(data []byte, header http.Header, requests *int32, downloads *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+
+		if etag := r.Header.Get("If-None-Match"); etag != "" && etag == header.Get("ETag") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if since := r.Header.Get("If-Modified-Since"); since != "" && header.Get("ETag") == "" && since == header.Get("Last-Modified") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt32(downloads, 1)
+		w.Write(data)
+	}))
+}
+
+// call the thumbnail handler with the given query and Accept header
+func requestThumbnail(query string, accept string, config *CommonServiceConfig) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/thumbnail?" + query, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	thumbnailHandler(w, r, config)
+	return w
+}
+
+func TestThumbnailHandlerFormat(t *testing.T) {
+	initTestManager(t)
+	server := newTestImageServer(newTestImage(400, 200), imaging.JPEG)
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.jpg") + "&width=100&height=100"
+
+	// source format, transparent padding is lost
+	w := requestThumbnail(query, "", &CommonServiceConfig{})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" || w.Header().Get("Vary") != "" {
+		t.Error("thumbnail should be a jpeg image")
+	}
+	if _, format, err := image.DecodeConfig(w.Body); err != nil || format != "jpeg" {
+		t.Error("thumbnail should be encoded as jpeg")
+	}
+
+	// explicit format
+	w = requestThumbnail(query + "&format=gif", "", &CommonServiceConfig{})
+	if w.Header().Get("Content-Type") != "image/gif" || w.Header().Get("Content-Disposition") != "attachment; filename=image.gif" {
+		t.Error("thumbnail should be a gif image")
+	}
+	if _, format, err := image.DecodeConfig(w.Body); err != nil || format != "gif" {
+		t.Error("thumbnail should be encoded as gif")
+	}
+
+	// auto, transparent padding is kept
+	w = requestThumbnail(query + "&format=auto", "image/webp,image/*,*/*;q=0.8", &CommonServiceConfig{})
+	if w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Vary") != "Accept" {
+		t.Error("thumbnail should be a png image, negotiated by Accept")
+	}
+	if _, format, err := image.DecodeConfig(w.Body); err != nil || format != "png" {
+		t.Error("thumbnail should be encoded as png")
+	}
+
+	// auto, opaque image
+	w = requestThumbnail(query + "&format=auto&fit=cover", "image/webp,image/*,*/*;q=0.8", &CommonServiceConfig{})
+	if w.Header().Get("Content-Type") != "image/jpeg" || w.Header().Get("Vary") != "Accept" {
+		t.Error("opaque thumbnail should be a jpeg image")
+	}
+}
+
+func TestThumbnailHandlerSourceFormats(t *testing.T) {
+	initTestManager(t)
+	srcImg := newTestImage(400, 200)
+
+	// source formats, detected by content, output keeps the format when an encoder exists
+	expected := map[imaging.Format]string{
+		imaging.JPEG: "image/jpeg",
+		imaging.PNG: "image/png",
+		imaging.GIF: "image/gif",
+		imaging.BMP: "image/png",
+		imaging.TIFF: "image/png",
+	}
+
+	for format, contentType := range expected {
+		server := newTestImageServer(srcImg, format)
+		w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/img/123?w=800") + "&width=100&height=100", "", &CommonServiceConfig{})
+		server.Close()
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("format %v: status %d, content type %s, expected %s", format, w.Code, w.Header().Get("Content-Type"), contentType)
+		}
+	}
+
+	// webp source, no webp encoder
+	server := httptest.NewServer(http.FileServer(http.Dir("testFiles")))
+	defer server.Close()
+
+	w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/image.webp") + "&width=100&height=100&fit=cover", "", &CommonServiceConfig{})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("webp source should be decoded, status %d", w.Code)
+	}
+
+	// not allowed source format
+	w = requestThumbnail("url=" + url.QueryEscape(server.URL + "/image.webp") + "&width=100&height=100", "", &CommonServiceConfig{SourceFormats: []string{"jpeg", "png"}})
+	if w.Code == http.StatusOK {
+		t.Error("not allowed source format should not be decoded")
+	}
+
+	// not an image
+	w = requestThumbnail("url=" + url.QueryEscape(server.URL + "/config_valid.yaml") + "&width=100&height=100", "", &CommonServiceConfig{})
+	if w.Code == http.StatusOK {
+		t.Error("not an image should not be decoded")
+	}
+
+	// extension required
+	w = requestThumbnail("url=" + url.QueryEscape(server.URL + "/img/123?w=800") + "&width=100&height=100", "", &CommonServiceConfig{CheckExtension: true})
+	if w.Code == http.StatusOK {
+		t.Error("url without extension should not be accepted")
+	}
+
+	// not valid service source formats
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_source", SourceFormats: []string{"svg"}}); err == nil {
+		t.Error("not supported service source format should not be registered")
+	}
+}
+
+func TestThumbnailHandlerMislabeledSource(t *testing.T) {
+	initTestManager(t)
+
+	// png content with a jpeg extension
+	server := newTestImageServer(newTestImage(400, 200), imaging.PNG)
+	defer server.Close()
+
+	w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/image.jpg") + "&width=100&height=100", "", &CommonServiceConfig{CheckExtension: true})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Error("source format should be detected by content")
+	}
+	if _, format, err := image.DecodeConfig(w.Body); err != nil || format != "png" {
+		t.Error("thumbnail should be encoded as the detected source format")
+	}
+}
+
+// create a colorful gradient image
+func newTestGradientImage(width int, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x + y) * 4), 255})
+		}
+	}
+	return img
+}
+
+// mean absolute difference per channel of two images of the same size
+func imageDifference(img1 image.Image, img2 image.Image) float64 {
+	b := img1.Bounds()
+	sum := 0.0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r1, g1, b1, _ := img1.At(x, y).RGBA()
+			r2, g2, b2, _ := img2.At(x, y).RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				if d < 0 {
+					d = -d
+				}
+				sum += float64(d)
+			}
+		}
+	}
+	return sum / float64(b.Dx()*b.Dy()*3)
+}
+
+func TestEncodeJpeg(t *testing.T) {
+	for _, size := range []image.Point{image.Pt(100, 80), image.Pt(37, 23), image.Pt(1, 1)} {
+		srcImg := newTestGradientImage(size.X, size.Y)
+
+		for _, opts := range []jpegOptions{
+			{90, false, chromaSubsampling420},
+			{90, false, chromaSubsampling444},
+			{90, true, chromaSubsampling420},
+			{90, true, chromaSubsampling444},
+		} {
+			var buf bytes.Buffer
+			if err := encodeJpeg(&buf, srcImg, opts); err != nil {
+				t.Fatal("jpeg should be encoded")
+			}
+			data := buf.Bytes()
+
+			// frame marker, baseline or progressive
+			marker := []byte{0xff, 0xc0}
+			if opts.progressive {
+				marker = []byte{0xff, 0xc2}
+			}
+			sof := bytes.Index(data, marker)
+			if sof < 0 {
+				t.Errorf("%v %v: frame marker not found", size, opts)
+				continue
+			}
+
+			// luminance sampling factors
+			sampling := byte(0x22)
+			if opts.subsampling == chromaSubsampling444 {
+				sampling = 0x11
+			}
+			if data[sof+11] != sampling {
+				t.Errorf("%v %v: sampling factors %x, expected %x", size, opts, data[sof+11], sampling)
+			}
+
+			dstImg, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("%v %v: jpeg should be decoded: %v", size, opts, err)
+				continue
+			}
+
+			if dstImg.Bounds().Size() != size {
+				t.Errorf("%v %v: decoded size %v", size, opts, dstImg.Bounds().Size())
+			}
+
+			if diff := imageDifference(srcImg, dstImg); diff > 4 {
+				t.Errorf("%v %v: decoded image difference %f too big", size, opts, diff)
+			}
+		}
+	}
+}
+
+func TestEncodeJpegQuality(t *testing.T) {
+	srcImg := newTestDetailImage(200, 200, image.Rect(0, 0, 200, 200))
+
+	for _, progressive := range []bool{false, true} {
+		var low, high bytes.Buffer
+		encodeJpeg(&low, srcImg, jpegOptions{10, progressive, chromaSubsampling444})
+		encodeJpeg(&high, srcImg, jpegOptions{100, progressive, chromaSubsampling444})
+		if low.Len() >= high.Len() {
+			t.Error("low quality should be smaller than high quality")
+		}
+	}
+}
+
+func TestFillThumbnailParamsJpeg(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+
+	// defaults
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.jpeg != (jpegOptions{jpegDefaultQuality, false, chromaSubsampling420}) {
+		t.Error("jpeg options should have default values")
+	}
+
+	// service defaults
+	config := &CommonServiceConfig{Quality: 60, Progressive: true, Chroma: "444"}
+	params, err = fillThumbnailParams(values, config)
+	if err != nil || params.jpeg != (jpegOptions{60, true, chromaSubsampling444}) {
+		t.Error("jpeg options should be taken from the service configuration")
+	}
+
+	// parameters override the service defaults
+	values.Set("q", "30")
+	values.Set("progressive", "false")
+	values.Set("chroma", "420")
+	params, err = fillThumbnailParams(values, config)
+	if err != nil || params.jpeg != (jpegOptions{30, false, chromaSubsampling420}) {
+		t.Error("jpeg parameters should override the service configuration")
+	}
+
+	for name, value := range map[string]string{"q": "0", "progressive": "maybe", "chroma": "422"} {
+		bad := url.Values{}
+		for k, v := range values {
+			bad[k] = v
+		}
+		bad.Set(name, value)
+		if _, err := fillThumbnailParams(bad, config); err == nil {
+			t.Error("not valid parameter should not be parsed: " + name)
+		}
+	}
+
+	values.Set("q", "101")
+	if _, err := fillThumbnailParams(values, config); err == nil {
+		t.Error("not valid quality should not be parsed")
+	}
+
+	// not valid service defaults
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_quality", Quality: 200}); err == nil {
+		t.Error("not valid service quality should not be registered")
+	}
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_chroma", Chroma: "411"}); err == nil {
+		t.Error("not valid service chroma should not be registered")
+	}
 }
 
+func TestThumbnailHandlerJpeg(t *testing.T) {
+	initTestManager(t)
+	server := newTestImageServer(newTestGradientImage(400, 200), imaging.JPEG)
+	defer server.Close()
 
+	query := "url=" + url.QueryEscape(server.URL + "/image.jpg") + "&width=100&height=100"
 
+	w := requestThumbnail(query + "&q=40&progressive=1", "", &CommonServiceConfig{})
+	if w.Code != http.StatusOK || w.Header().Get("X-Thumbnail-Quality") != "40" {
+		t.Error("effective quality should be reported")
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte{0xff, 0xc2}) == false {
+		t.Error("thumbnail should be progressive")
+	}
+
+	w = requestThumbnail(query, "", &CommonServiceConfig{Quality: 70})
+	if w.Header().Get("X-Thumbnail-Quality") != "70" {
+		t.Error("service quality should be reported")
+	}
+
+	// no quality for other formats
+	w = requestThumbnail(query + "&format=png&q=40", "", &CommonServiceConfig{})
+	if w.Code != http.StatusOK || w.Header().Get("X-Thumbnail-Quality") != "" {
+		t.Error("quality should be reported for jpeg only")
+	}
+}
+
+// encode jpeg with an exif segment
+func newTestExifJpeg(img image.Image, entries []exifEntry) []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, nil)
+	return insertExifSegment(buf.Bytes(), buildExifSegment(entries))
+}
+
+// exif entries of a phone photo: orientation, gps and copyright
+var testExifEntries = []exifEntry{
+	{exifTagOrientation, exifTypeShort, uint16(6)},
+	{exifTagArtist, exifTypeAscii, "Jane Doe"},
+	{exifTagCopyright, exifTypeAscii, "(c) 2018 Example"},
+	{0x8825, exifTypeLong, uint32(1234)}, // gps ifd pointer
+}
+
+func TestReadExif(t *testing.T) {
+	data, err := readExif(bytes.NewReader(newTestExifJpeg(newTestImage(10, 10), testExifEntries)))
+	if err != nil || data.orientation != 6 || data.artist != "Jane Doe" || data.copyright != "(c) 2018 Example" {
+		t.Errorf("exif not as expected: %v %v", data, err)
+	}
+
+	// short ascii value, inside the entry
+	data, err = readExif(bytes.NewReader(newTestExifJpeg(newTestImage(10, 10), []exifEntry{{exifTagCopyright, exifTypeAscii, "abc"}})))
+	if err != nil || data.copyright != "abc" || data.orientation != 0 {
+		t.Errorf("exif not as expected: %v %v", data, err)
+	}
+
+	// little endian
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0, 0x12, 0x01, 3, 0, 1, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	segment := append([]byte{0xff, 0xe1, 0, byte(2 + len(exifHeader) + len(tiff))}, append(append([]byte{}, exifHeader...), tiff...)...)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, newTestImage(10, 10), nil)
+	data, err = readExif(bytes.NewReader(insertExifSegment(buf.Bytes(), segment)))
+	if err != nil || data.orientation != 3 {
+		t.Errorf("little endian exif not as expected: %v %v", data, err)
+	}
+
+	// no exif
+	data, err = readExif(bytes.NewReader(buf.Bytes()))
+	if err != nil || *data != (exifData{}) {
+		t.Error("jpeg without exif should have empty data")
+	}
+
+	// truncated exif
+	truncated := newTestExifJpeg(newTestImage(10, 10), testExifEntries)[:40]
+	if _, err := readExif(bytes.NewReader(truncated)); err != nil {
+		t.Error("truncated exif should be ignored")
+	}
+
+	// not a jpeg
+	if _, err := readExif(bytes.NewReader([]byte("not a jpeg"))); err == nil {
+		t.Error("not a jpeg should not be parsed")
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 3x2 image, marked top left pixel
+	srcImg := imaging.New(3, 2, color.NRGBA{0, 0, 0, 255})
+	srcImg.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+
+	// size and position of the marked pixel after the transformation
+	expected := map[int][2]image.Point{
+		1: {image.Pt(3, 2), image.Pt(0, 0)},
+		2: {image.Pt(3, 2), image.Pt(2, 0)},
+		3: {image.Pt(3, 2), image.Pt(2, 1)},
+		4: {image.Pt(3, 2), image.Pt(0, 1)},
+		5: {image.Pt(2, 3), image.Pt(0, 0)},
+		6: {image.Pt(2, 3), image.Pt(1, 0)},
+		7: {image.Pt(2, 3), image.Pt(1, 2)},
+		8: {image.Pt(2, 3), image.Pt(0, 2)},
+	}
+
+	for orientation, res := range expected {
+		dstImg := applyOrientation(srcImg, orientation)
+		if dstImg.Bounds().Size() != res[0] {
+			t.Errorf("orientation %d: size %v, expected %v", orientation, dstImg.Bounds().Size(), res[0])
+		}
+		if r, _, _, _ := dstImg.At(res[1].X, res[1].Y).RGBA(); r == 0 {
+			t.Errorf("orientation %d: marked pixel should be at %v", orientation, res[1])
+		}
+	}
+}
+
+func TestThumbnailHandlerExif(t *testing.T) {
+	initTestManager(t)
+
+	// left half red, right half blue, rotated by the camera
+	srcImg := imaging.Paste(newTestImage(400, 200), imaging.New(200, 200, color.NRGBA{0, 0, 255, 255}), image.Pt(200, 0))
+	source := newTestExifJpeg(srcImg, testExifEntries)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(source)
+	}))
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.jpg") + "&width=100&height=200&fit=fill"
+
+	// displayed upright: red on top, metadata stripped
+	w := requestThumbnail(query, "", &CommonServiceConfig{})
+	dstImg, err := jpeg.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil || dstImg.Bounds().Size() != image.Pt(100, 200) {
+		t.Fatal("thumbnail should be rotated by the exif orientation")
+	}
+	if r, _, b, _ := dstImg.At(50, 20).RGBA(); r>>8 < 200 || b>>8 > 50 {
+		t.Error("thumbnail top should be red")
+	}
+	if bytes.Contains(w.Body.Bytes(), exifHeader) {
+		t.Error("thumbnail metadata should be stripped")
+	}
+
+	// copyright kept, nothing else
+	w = requestThumbnail(query + "&keepmeta=true", "", &CommonServiceConfig{})
+	data, err := readExif(bytes.NewReader(w.Body.Bytes()))
+	if err != nil || data.copyright != "(c) 2018 Example" || data.artist != "Jane Doe" || data.orientation != 0 {
+		t.Errorf("thumbnail should keep the copyright metadata only: %v", data)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte{0x88, 0x25}) {
+		t.Error("thumbnail gps metadata should be stripped")
+	}
+
+	// service default
+	w = requestThumbnail(query, "", &CommonServiceConfig{KeepMeta: true})
+	if bytes.Contains(w.Body.Bytes(), exifHeader) == false {
+		t.Error("service default should keep the copyright metadata")
+	}
+
+	values := url.Values{"url": {"http://www.example.com/image.jpg"}, "width": {"1"}, "height": {"1"}, "keepmeta": {"xxx"}}
+	if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+		t.Error("not valid keepmeta should not be parsed")
+	}
+}
+
+func TestFillThumbnailParamsFilter(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+
+	// default filter
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.filter != "lanczos" {
+		t.Error("filter should default to lanczos")
+	}
+
+	// service default
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{Filter: "box"})
+	if err != nil || params.filter != "box" {
+		t.Error("filter should be taken from the service configuration")
+	}
+
+	for _, filter := range []string{"nearest", "box", "linear", "catmullrom", "lanczos", "Mitchell"} {
+		values.Set("filter", filter)
+		if _, err := fillThumbnailParams(values, &CommonServiceConfig{Filter: "box"}); err != nil {
+			t.Error("valid filter should be parsed: " + filter)
+		}
+	}
+
+	values.Set("filter", "bicubic")
+	if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+		t.Error("not valid filter should not be parsed")
+	}
+
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_filter", Filter: "bicubic"}); err == nil {
+		t.Error("not valid service filter should not be registered")
+	}
+}
+
+func TestThumbnailTransformFilter(t *testing.T) {
+	// 2x2 checkerboard scaled up, nearest neighbour keeps the hard edges
+	srcImg := imaging.New(2, 2, color.NRGBA{0, 0, 0, 255})
+	srcImg.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	srcImg.SetNRGBA(1, 1, color.NRGBA{255, 255, 255, 255})
+
+	params := &thumbnailParameters{width: 8, height: 8, fit: fitFill, filter: "nearest"}
+	dstImg := thumbnailTransform(srcImg, params)
+	for _, pt := range []image.Point{image.Pt(3, 0), image.Pt(3, 3), image.Pt(4, 4)} {
+		if r, _, _, _ := dstImg.At(pt.X, pt.Y).RGBA(); r>>8 != 0 && r>>8 != 255 {
+			t.Errorf("nearest filter should not blend pixels, got %d at %v", r>>8, pt)
+		}
+	}
+
+	params.filter = "linear"
+	dstImg = thumbnailTransform(srcImg, params)
+	if r, _, _, _ := dstImg.At(3, 3).RGBA(); r>>8 == 0 || r>>8 == 255 {
+		t.Error("linear filter should blend pixels")
+	}
+}
+
+func BenchmarkThumbnailFilters(b *testing.B) {
+	srcImg := newTestGradientImage(4000, 3000)
+
+	for _, filter := range []string{"nearest", "box", "linear", "catmullrom", "lanczos", "mitchell"} {
+		b.Run(filter, func(b *testing.B) {
+			params := &thumbnailParameters{width: 300, height: 200, fit: fitFill, filter: filter}
+			for i := 0; i < b.N; i++ {
+				thumbnailTransform(srcImg, params)
+			}
+		})
+	}
+}
+
+func TestFillThumbnailParamsDpr(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+	values.Set("height", "200")
+
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.dpr != 0 {
+		t.Error("dpr should not be set by default")
+	}
+
+	values.Set("dpr", "2")
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.dpr != 2 {
+		t.Error("valid dpr should be parsed")
+	}
+
+	// capped by the service maximum
+	values.Set("dpr", "5")
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.dpr != dprDefaultMax {
+		t.Error("dpr should be capped by the default maximum")
+	}
+
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{MaxDpr: 2, DprUpscale: true})
+	if err != nil || params.dpr != 2 || params.dprUpscale == false {
+		t.Error("dpr should be capped by the service maximum")
+	}
+
+	for _, value := range []string{"0", "-1", "x", "NaN", "Inf"} {
+		values.Set("dpr", value)
+		if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+			t.Error("not valid dpr should not be parsed: " + value)
+		}
+	}
+
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_dpr", MaxDpr: -1}); err == nil {
+		t.Error("not valid service maxdpr should not be registered")
+	}
+}
+
+func TestThumbnailSizeDpr(t *testing.T) {
+	// size, dpr, upscale allowed, source size => thumbnail size, dpr used
+	tests := []struct {
+		width, height int
+		dpr float64
+		upscale bool
+		srcWidth, srcHeight int
+		dstWidth, dstHeight int
+		dprUsed float64
+	}{
+		{100, 50, 0, false, 1000, 1000, 100, 50, 1},
+		{100, 50, 2, false, 1000, 1000, 200, 100, 2},
+		{100, 50, 3, false, 250, 1000, 250, 125, 2.5},
+		{100, 50, 3, false, 1000, 100, 200, 100, 2},
+		{100, 50, 2, false, 50, 50, 100, 50, 1},
+		{100, 50, 0.5, false, 50, 50, 50, 25, 0.5},
+		{100, 50, 3, true, 250, 100, 300, 150, 3},
+	}
+
+	for _, test := range tests {
+		params := &thumbnailParameters{width: test.width, height: test.height, dpr: test.dpr, dprUpscale: test.upscale}
+		width, height := thumbnailSize(params, test.srcWidth, test.srcHeight)
+		if width != test.dstWidth || height != test.dstHeight || params.dprUsed != test.dprUsed {
+			t.Errorf("%v: size %dx%d dpr %v", test, width, height, params.dprUsed)
+		}
+	}
+}
+
+func TestThumbnailHandlerDpr(t *testing.T) {
+	initTestManager(t)
+	server := newTestImageServer(newTestImage(500, 250), imaging.PNG)
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100&height=50"
+
+	w := requestThumbnail(query, "", &CommonServiceConfig{})
+	if w.Header().Get("Content-DPR") != "" {
+		t.Error("Content-DPR should be sent only when dpr is requested")
+	}
+
+	w = requestThumbnail(query + "&dpr=2", "", &CommonServiceConfig{})
+	img, _, err := image.DecodeConfig(w.Body)
+	if err != nil || img.Width != 200 || img.Height != 100 || w.Header().Get("Content-DPR") != "2" {
+		t.Error("thumbnail should be scaled by the dpr")
+	}
+
+	// not bigger than the source
+	w = requestThumbnail(query + "&dpr=6", "", &CommonServiceConfig{MaxDpr: 10})
+	img, _, err = image.DecodeConfig(w.Body)
+	if err != nil || img.Width != 500 || img.Height != 250 || w.Header().Get("Content-DPR") != "5" {
+		t.Error("dpr should not upscale the source")
+	}
+}
+
+func TestFillThumbnailParamsSize(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+
+	// at least one dimension
+	if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+		t.Error("size missing, function should return error")
+	}
+
+	values.Set("height", "200")
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.width != 0 || params.height != 200 {
+		t.Error("height only should be parsed")
+	}
+
+	values.Del("height")
+	values.Set("maxw", "300")
+	values.Set("maxh", "400")
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.width != 0 || params.height != 0 || params.maxWidth != 300 || params.maxHeight != 400 {
+		t.Error("bounding size only should be parsed")
+	}
+
+	for _, name := range []string{"width", "height", "maxw", "maxh"} {
+		for _, value := range []string{"0", "-10", "x"} {
+			bad := url.Values{"url": {"http://www.example.com/image.jpg"}, "width": {"10"}}
+			bad.Set(name, value)
+			if _, err := fillThumbnailParams(bad, &CommonServiceConfig{}); err == nil {
+				t.Errorf("not valid %s should not be parsed: %s", name, value)
+			}
+		}
+	}
+}
+
+func TestThumbnailSize(t *testing.T) {
+	// requested size, bounds and source size => thumbnail size
+	tests := []struct {
+		width, height int
+		maxWidth, maxHeight int
+		srcWidth, srcHeight int
+		dstWidth, dstHeight int
+	}{
+		{100, 50, 0, 0, 400, 400, 100, 50},
+		{100, 0, 0, 0, 400, 200, 100, 50},
+		{0, 100, 0, 0, 400, 200, 200, 100},
+		{0, 0, 300, 0, 600, 200, 300, 100},
+		{0, 0, 0, 100, 600, 200, 300, 100},
+		{0, 0, 300, 300, 600, 400, 300, 200},
+		{0, 0, 800, 800, 600, 400, 600, 400},
+		{400, 0, 200, 0, 400, 100, 200, 50},
+		{400, 400, 0, 100, 400, 100, 100, 100},
+		{0, 10, 0, 0, 3000, 1, 30000, 10},
+		{1, 0, 0, 0, 3000, 1, 1, 1},
+	}
+
+	for _, test := range tests {
+		params := &thumbnailParameters{width: test.width, height: test.height, maxWidth: test.maxWidth, maxHeight: test.maxHeight}
+		width, height := thumbnailSize(params, test.srcWidth, test.srcHeight)
+		if width != test.dstWidth || height != test.dstHeight {
+			t.Errorf("%v: size %dx%d", test, width, height)
+		}
+	}
+}
+
+func TestThumbnailHandlerSize(t *testing.T) {
+	initTestManager(t)
+	server := newTestImageServer(newTestImage(500, 250), imaging.PNG)
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.png")
+
+	expected := map[string]image.Point{
+		"&width=100": image.Pt(100, 50),
+		"&height=100": image.Pt(200, 100),
+		"&maxw=300": image.Pt(300, 150),
+		"&maxw=300&maxh=100": image.Pt(200, 100),
+		"&width=100&dpr=2": image.Pt(200, 100),
+		"&height=100&fit=cover": image.Pt(200, 100),
+	}
+
+	for size, dstSize := range expected {
+		w := requestThumbnail(query + size, "", &CommonServiceConfig{})
+		img, _, err := image.DecodeConfig(w.Body)
+		if err != nil || image.Pt(img.Width, img.Height) != dstSize {
+			t.Errorf("%s: thumbnail size %dx%d, expected %v", size, img.Width, img.Height, dstSize)
+		}
+	}
+}
+
+// bounds of the not transparent pixels
+func opaqueBounds(img image.Image) image.Rectangle {
+	bounds := image.Rectangle{}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return bounds
+}
+
+func TestThumbnailTransformUpscale(t *testing.T) {
+	// fit, policy, source size, requested size => output size, image size inside the output
+	tests := []struct {
+		fit, upscale string
+		srcWidth, srcHeight int
+		width, height int
+		dstWidth, dstHeight int
+		imgWidth, imgHeight int
+	}{
+		// downscale, the policy does not matter
+		{fitPad, upscaleAlways, 400, 200, 100, 100, 100, 100, 100, 50},
+		{fitPad, upscaleNever, 400, 200, 100, 100, 100, 100, 100, 50},
+		{fitPad, upscalePadOnly, 400, 200, 100, 100, 100, 100, 100, 50},
+		{fitCover, upscaleNever, 400, 200, 100, 100, 100, 100, 100, 100},
+		{fitFill, upscaleNever, 400, 200, 100, 100, 100, 100, 100, 100},
+		{fitInside, upscaleNever, 400, 200, 100, 100, 100, 50, 100, 50},
+
+		// same aspect ratio, bigger than the source
+		{fitPad, upscaleAlways, 80, 40, 200, 100, 200, 100, 200, 100},
+		{fitPad, upscaleNever, 80, 40, 200, 100, 80, 40, 80, 40},
+		{fitPad, upscalePadOnly, 80, 40, 200, 100, 200, 100, 80, 40},
+		{fitCover, upscaleAlways, 80, 40, 200, 100, 200, 100, 200, 100},
+		{fitCover, upscaleNever, 80, 40, 200, 100, 80, 40, 80, 40},
+		{fitCover, upscalePadOnly, 80, 40, 200, 100, 200, 100, 80, 40},
+		{fitFill, upscaleAlways, 80, 40, 200, 100, 200, 100, 200, 100},
+		{fitFill, upscaleNever, 80, 40, 200, 100, 80, 40, 80, 40},
+		{fitFill, upscalePadOnly, 80, 40, 200, 100, 200, 100, 80, 40},
+		{fitInside, upscaleAlways, 80, 40, 200, 100, 200, 100, 200, 100},
+		{fitInside, upscaleNever, 80, 40, 200, 100, 80, 40, 80, 40},
+		{fitInside, upscalePadOnly, 80, 40, 200, 100, 80, 40, 80, 40},
+
+		// almost the same aspect ratio, same results
+		{fitPad, upscaleAlways, 80, 41, 200, 100, 200, 100, 195, 100},
+		{fitPad, upscaleNever, 80, 41, 200, 100, 82, 41, 80, 41},
+		{fitPad, upscalePadOnly, 80, 41, 200, 100, 200, 100, 80, 41},
+
+		// other aspect ratio, only the crop enlarges
+		{fitPad, upscaleAlways, 50, 100, 100, 100, 100, 100, 50, 100},
+		{fitPad, upscaleNever, 50, 100, 100, 100, 100, 100, 50, 100},
+		{fitCover, upscaleAlways, 50, 100, 100, 100, 100, 100, 100, 100},
+		{fitCover, upscaleNever, 50, 100, 100, 100, 50, 50, 50, 50},
+		{fitCover, upscalePadOnly, 50, 100, 100, 100, 100, 100, 50, 100},
+		{fitFill, upscaleNever, 50, 100, 100, 100, 50, 100, 50, 100},
+		{fitFill, upscalePadOnly, 50, 100, 100, 100, 100, 100, 50, 100},
+		{fitInside, upscaleAlways, 50, 100, 100, 100, 50, 100, 50, 100},
+		{fitCover, upscaleNever, 50, 100, 200, 100, 50, 25, 50, 25},
+		{fitCover, upscalePadOnly, 50, 100, 200, 100, 200, 100, 50, 100},
+
+		// other aspect ratio, bigger than the source
+		{fitPad, upscaleAlways, 50, 100, 300, 300, 300, 300, 150, 300},
+		{fitPad, upscaleNever, 50, 100, 300, 300, 100, 100, 50, 100},
+		{fitPad, upscalePadOnly, 50, 100, 300, 300, 300, 300, 50, 100},
+		{fitInside, upscaleAlways, 50, 100, 300, 300, 150, 300, 150, 300},
+	}
+
+	for _, test := range tests {
+		srcImg := newTestImage(test.srcWidth, test.srcHeight)
+		params := &thumbnailParameters{width: test.width, height: test.height, fit: test.fit, upscale: test.upscale}
+
+		dstImg := thumbnailTransform(srcImg, params)
+		if dstImg.Bounds().Size() != image.Pt(test.dstWidth, test.dstHeight) {
+			t.Errorf("%v: output size %v", test, dstImg.Bounds().Size())
+		}
+		if opaqueBounds(dstImg).Size() != image.Pt(test.imgWidth, test.imgHeight) {
+			t.Errorf("%v: image size %v", test, opaqueBounds(dstImg).Size())
+		}
+
+		// deterministic
+		if dstImg2 := thumbnailTransform(srcImg, params); imageDifference(dstImg, dstImg2) != 0 {
+			t.Errorf("%v: output not deterministic", test)
+		}
+	}
+}
+
+func TestFillThumbnailParamsUpscale(t *testing.T) {
+	values := make(url.Values)
+	values.Set("url", "http://www.example.com/image.jpg")
+	values.Set("width", "100")
+
+	params, err := fillThumbnailParams(values, &CommonServiceConfig{})
+	if err != nil || params.upscale != upscaleDefault {
+		t.Error("upscale should have the default value")
+	}
+
+	params, err = fillThumbnailParams(values, &CommonServiceConfig{Upscale: "never"})
+	if err != nil || params.upscale != upscaleNever {
+		t.Error("upscale should be taken from the service configuration")
+	}
+
+	for _, value := range []string{"never", "always", "pad-only", "NEVER"} {
+		values.Set("upscale", value)
+		if _, err := fillThumbnailParams(values, &CommonServiceConfig{Upscale: "never"}); err != nil {
+			t.Error("valid upscale should be parsed: " + value)
+		}
+	}
+
+	values.Set("upscale", "sometimes")
+	if _, err := fillThumbnailParams(values, &CommonServiceConfig{}); err == nil {
+		t.Error("not valid upscale should not be parsed")
+	}
+
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/thumbnail_upscale", Upscale: "sometimes"}); err == nil {
+		t.Error("not valid service upscale should not be registered")
+	}
+}
+
+func TestDownloadSource(t *testing.T) {
+	initTestManager(t)
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	tmpPath, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		t.Fatal("Cannot create temporary path")
+	}
+	defer os.RemoveAll(tmpPath)
+	spoolPath := filepath.Join(tmpPath, "spool")
+
+	// in memory
+	for _, threshold := range []int64{1000, 5000} {
+		src, err := downloadSource(&sourceRequest{url: server.URL}, spoolPath, threshold)
+		if err != nil || src.file != nil {
+			t.Fatal("source should be kept in memory")
+		}
+		if res, _ := ioutil.ReadAll(src); bytes.Equal(res, data) == false {
+			t.Error("source data not as expected")
+		}
+		if _, err := os.Stat(spoolPath); err == nil {
+			t.Error("spool file should not be created")
+		}
+		src.Close()
+	}
+
+	// spooled
+	src, err := downloadSource(&sourceRequest{url: server.URL}, spoolPath, 999)
+	if err != nil || src.file == nil {
+		t.Fatal("source should be spooled")
+	}
+	if res, _ := ioutil.ReadAll(src); bytes.Equal(res, data) == false {
+		t.Error("source data not as expected")
+	}
+	if _, err := os.Stat(spoolPath); err != nil {
+		t.Error("spool file should exist")
+	}
+	src.Close()
+	if _, err := os.Stat(spoolPath); err == nil {
+		t.Error("spool file should be deleted")
+	}
+
+	// download error
+	if _, err := downloadSource(&sourceRequest{url: "http://127.0.0.1:0/image.jpg"}, spoolPath, 999); err == nil {
+		t.Error("download error should be returned")
+	}
+}
+
+func TestThumbnailHandlerSpool(t *testing.T) {
+	initTestManager(t)
+	tmpPath, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		t.Fatal("Cannot create temporary path")
+	}
+	defer os.RemoveAll(tmpPath)
+
+	gServiceManager.config.TempPath = tmpPath
+	gServiceManager.config.SpoolThreshold = 100
+	defer func() { gServiceManager.config.SpoolThreshold = 0 }()
+
+	server := newTestImageServer(newTestGradientImage(400, 200), imaging.PNG)
+	defer server.Close()
+
+	w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100", "", &CommonServiceConfig{})
+	if img, _, err := image.DecodeConfig(w.Body); err != nil || img.Width != 100 || img.Height != 50 {
+		t.Error("spooled source should be resized")
+	}
+
+	if files, _ := ioutil.ReadDir(tmpPath); len(files) != 0 {
+		t.Error("spool file should be deleted at the end of the session")
+	}
+}
+
+func TestNormalizeUrl(t *testing.T) {
+	for _, test := range []struct {
+		url string
+		expected string
+	}{
+		{"http://Example.COM:80/a/b.jpg?z=1&a=2#top", "http://example.com/a/b.jpg?a=2&z=1"},
+		{"HTTPS://example.com:443/b.jpg", "https://example.com/b.jpg"},
+		{"http://example.com:8080/b.jpg", "http://example.com:8080/b.jpg"},
+		{"http://example.com/B.jpg", "http://example.com/B.jpg"},
+	} {
+		if res := normalizeUrl(test.url); res != test.expected {
+			t.Error("url " + test.url + " should be normalized to " + test.expected + ", got " + res)
+		}
+	}
+}
+
+func TestThumbnailCacheKey(t *testing.T) {
+	initTestManager(t)
+	config := &CommonServiceConfig{}
+
+	key := func(query string, accept string) string {
+		params, err := fillThumbnailParams(parseQuery(t, query), config)
+		if err != nil {
+			t.Fatal("params should be valid: " + query)
+		}
+		params.accept = accept
+		return thumbnailCacheKey(params)
+	}
+
+	base := key("url=http://example.com/a.jpg?x=1%26y=2&width=100", "")
+	if base != key("url=HTTP://example.com:80/a.jpg?y=2%26x=1&width=100", "") {
+		t.Error("equivalent urls should have the same key")
+	}
+
+	for _, query := range []string{"url=http://example.com/b.jpg&width=100", "url=http://example.com/a.jpg?x=1%26y=2&width=101",
+		"url=http://example.com/a.jpg?x=1%26y=2&width=100&fit=cover", "url=http://example.com/a.jpg?x=1%26y=2&width=100&q=80",
+		"url=http://example.com/a.jpg?x=1%26y=2&width=100&format=png", "url=http://example.com/a.jpg?x=1%26y=2&width=100&bg=blur"} {
+		if key(query, "") == base {
+			t.Error("different parameters should have a different key: " + query)
+		}
+	}
+
+	// auto format depends only on the accepted output formats
+	auto := "url=http://example.com/a.jpg&width=100&format=auto"
+	if key(auto, "image/webp,image/*,*/*;q=0.8") != key(auto, "image/*") {
+		t.Error("same accepted formats should have the same key")
+	}
+	if key(auto, "image/png") == key(auto, "image/*") {
+		t.Error("different accepted formats should have a different key")
+	}
+	if key("url=http://example.com/a.jpg&width=100", "image/png") != key("url=http://example.com/a.jpg&width=100", "image/*") {
+		t.Error("Accept should not change the key of a fixed format")
+	}
+}
+
+// parse query string, fail the test on error
+func parseQuery(t *testing.T, query string) url.Values {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal("query not valid: " + query)
+	}
+	return values
+}
+
+func TestDiskCache(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	if _, err := newDiskCache(cachePath, 0); err == nil {
+		t.Error("max size should be validated")
+	}
+
+	cache, err := newDiskCache(cachePath, 1000)
+	if err != nil {
+		t.Fatal("Cannot create disk cache")
+	}
+
+	newEntry := func(size int) *cacheEntry {
+		header := http.Header{}
+		header.Set("Content-Type", "image/png")
+		return &cacheEntry{header: header, data: bytes.Repeat([]byte{1}, size)}
+	}
+
+	if cache.Get("a") != nil {
+		t.Error("empty cache should miss")
+	}
+
+	if err := cache.Put("a", newEntry(400)); err != nil {
+		t.Fatal("entry should be cached")
+	}
+	entry := cache.Get("a")
+	if entry == nil || len(entry.data) != 400 || entry.header.Get("Content-Type") != "image/png" {
+		t.Fatal("cached entry not as expected")
+	}
+
+	if err := cache.Put("big", newEntry(1000)); err == nil {
+		t.Error("entry bigger than the cache should not be cached")
+	}
+
+	// least recently used is evicted
+	cache.Put("b", newEntry(400))
+	cache.Get("a")
+	cache.Put("c", newEntry(400))
+	if cache.Get("b") != nil || cache.Get("a") == nil || cache.Get("c") == nil {
+		t.Error("least recently used entry should be evicted")
+	}
+	if cache.size > 1000 {
+		t.Error("cache size should not exceed max size")
+	}
+
+	// written atomically, no temporary files left
+	files, _ := ioutil.ReadDir(cachePath)
+	if len(files) != 2 {
+		t.Error("cache path should hold only the cached entries")
+	}
+
+	// entries survive restart
+	cache, err = newDiskCache(cachePath, 1000)
+	if err != nil {
+		t.Fatal("Cannot reopen disk cache")
+	}
+	if entry := cache.Get("c"); entry == nil || len(entry.data) != 400 {
+		t.Error("cached entry should be loaded on restart")
+	}
+
+	// restart with a smaller size evicts
+	cache, err = newDiskCache(cachePath, 500)
+	if err != nil {
+		t.Fatal("Cannot reopen disk cache")
+	}
+	if len(cache.items) != 1 || cache.Get("c") == nil {
+		t.Error("most recently used entry should be kept on restart")
+	}
+}
+
+func TestDiskCacheJanitor(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	cache, err := newDiskCache(cachePath, 1000)
+	if err != nil {
+		t.Fatal("Cannot create disk cache")
+	}
+
+	cache.Put("a", &cacheEntry{header: http.Header{}, data: []byte("a")})
+	cache.Put("b", &cacheEntry{header: http.Header{}, data: []byte("b")})
+
+	// interrupted write and externally removed entry
+	tmpFile := filepath.Join(cachePath, diskCacheTmpPrefix + "1")
+	ioutil.WriteFile(tmpFile, []byte("partial"), 0644)
+	os.Remove(filepath.Join(cachePath, diskCacheName("b")))
+
+	cache.startJanitor(10 * time.Millisecond)
+	defer cache.stopJanitor()
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		cache.mutex.Lock()
+		count := len(cache.items)
+		cache.mutex.Unlock()
+		if _, err := os.Stat(tmpFile); os.IsNotExist(err) && count == 1 {
+			break
+		}
+	}
+
+	if _, err := os.Stat(tmpFile); os.IsNotExist(err) == false {
+		t.Error("interrupted write should be removed")
+	}
+	if cache.Get("b") != nil || cache.Get("a") == nil {
+		t.Error("index should be synced with the disk")
+	}
+}
+
+func TestDiskCacheSyncConcurrentPut(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	cache, err := newDiskCache(cachePath, 1 << 20)
+	if err != nil {
+		t.Fatal("Cannot create disk cache")
+	}
+
+	// entries written while the janitor lists the directory are kept
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cache.sync(time.Hour)
+			}
+		}
+	}()
+
+	for i := 0; i < 300; i++ {
+		cache.Put(strconv.Itoa(i), &cacheEntry{header: http.Header{}, data: []byte("a")})
+	}
+	close(stop)
+	<-done
+
+	for i := 0; i < 300; i++ {
+		if cache.Get(strconv.Itoa(i)) == nil {
+			t.Fatalf("entry %d written during sync should be kept", i)
+		}
+	}
+}
+
+func TestDiskCacheForeignFiles(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	// files of the application sharing the directory
+	foreign := []string{"config.yaml", "1234image.jpg", ".tmp-1", diskCacheName("other")}
+	for _, name := range foreign {
+		ioutil.WriteFile(filepath.Join(cachePath, name), []byte("data"), 0644)
+	}
+
+	cache, err := newDiskCache(cachePath, 1000)
+	if err != nil {
+		t.Fatal("Cannot create disk cache")
+	}
+	cache.Put("a", &cacheEntry{header: http.Header{}, data: []byte("a")})
+	if err := cache.sync(0); err != nil {
+		t.Fatal("Cannot sync disk cache")
+	}
+
+	for _, name := range foreign {
+		if _, err := os.Stat(filepath.Join(cachePath, name)); err != nil {
+			t.Error("file which is not a cache entry should be kept: " + name)
+		}
+	}
+	if entries, _ := cache.Stats(); entries != 1 || cache.Get("a") == nil {
+		t.Error("only cache entries should be indexed")
+	}
+}
+
+func TestInitCachePaths(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	tests := []struct {
+		config ServiceManagerConfig
+		valid bool
+	}{
+		{ServiceManagerConfig{TempPath: ".", Cache: CacheConfig{Path: filepath.Join(cachePath, "thumbnails"), MaxSize: 1000, SourcePath: filepath.Join(cachePath, "sources"), SourceMaxSize: 1000}}, true},
+		{ServiceManagerConfig{TempPath: ".", Cache: CacheConfig{Path: ".", MaxSize: 1000}}, false},
+		{ServiceManagerConfig{TempPath: cachePath, Cache: CacheConfig{SourcePath: cachePath + "/", SourceMaxSize: 1000}}, false},
+		{ServiceManagerConfig{TempPath: ".", Cache: CacheConfig{Path: cachePath, MaxSize: 1000, SourcePath: cachePath, SourceMaxSize: 1000}}, false},
+	}
+
+	for i, test := range tests {
+		manager := &serviceManager{config: test.config}
+		err := manager.initCache()
+		if (err == nil) != test.valid {
+			t.Errorf("cache paths %d valid should be %v", i, test.valid)
+		}
+		for _, cache := range []*diskCache{manager.diskCache, manager.sourceCache} {
+			if cache != nil {
+				cache.stopJanitor()
+			}
+		}
+	}
+}
+
+func TestThumbnailHandlerDiskCache(t *testing.T) {
+	initTestManager(t)
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	cache, err := newDiskCache(cachePath, 1 << 20)
+	if err != nil {
+		t.Fatal("Cannot create disk cache")
+	}
+	gServiceManager.diskCache = cache
+	defer func() { gServiceManager.diskCache = nil }()
+
+	var count int32
+	server := newTestCountingServer(newTestGradientImage(400, 200), imaging.PNG, &count)
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100"
+
+	miss := requestThumbnail(query, "", &CommonServiceConfig{})
+	if miss.Code != http.StatusOK || miss.Header().Get("X-Cache") != "MISS" {
+		t.Fatal("first request should miss")
+	}
+
+	hit := requestThumbnail(query, "", &CommonServiceConfig{})
+	if hit.Code != http.StatusOK || hit.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("second request should hit")
+	}
+	if atomic.LoadInt32(&count) != 1 {
+		t.Error("cache hit should not download the source")
+	}
+	if bytes.Equal(hit.Body.Bytes(), miss.Body.Bytes()) == false || hit.Header().Get("Content-Type") != miss.Header().Get("Content-Type") ||
+		hit.Header().Get("Content-Disposition") != miss.Header().Get("Content-Disposition") {
+		t.Error("cache hit should be the same as the rendered thumbnail")
+	}
+
+	// other parameters are rendered
+	if w := requestThumbnail(query + "&format=gif", "", &CommonServiceConfig{}); w.Header().Get("X-Cache") != "MISS" ||
+		w.Header().Get("Content-Type") != "image/gif" {
+		t.Error("different parameters should miss")
+	}
+	if atomic.LoadInt32(&count) != 2 {
+		t.Error("cache miss should download the source")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	newEntry := func(size int) *cacheEntry {
+		return &cacheEntry{header: http.Header{}, data: bytes.Repeat([]byte{1}, size)}
+	}
+
+	cache := newMemoryCache(1000)
+	if cache.Get("http://a/1") != nil {
+		t.Error("empty cache should miss")
+	}
+
+	cache.Put("http://a/1", newEntry(400))
+	cache.Put("http://a/2", newEntry(400))
+	cache.Put("http://big", newEntry(1000))
+	if entry := cache.Get("http://a/1"); entry == nil || len(entry.data) != 400 {
+		t.Fatal("entry should be cached")
+	}
+	if cache.Get("http://big") != nil {
+		t.Error("entry bigger than the budget should not be cached")
+	}
+
+	// least recently used is evicted
+	cache.Put("http://b/1", newEntry(400))
+	if cache.Get("http://a/2") != nil || cache.Get("http://a/1") == nil || cache.Get("http://b/1") == nil {
+		t.Error("least recently used entry should be evicted")
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Size > 1000 || stats.Hits != 3 || stats.Misses != 3 || stats.Evictions != 1 {
+		t.Errorf("counters not as expected: %+v", stats)
+	}
+
+	// purge by prefix
+	cache.Put("http://a/3", newEntry(100))
+	if res := cache.Purge("http://a/"); res != 2 {
+		t.Errorf("2 entries should be purged, got %d", res)
+	}
+	if cache.Get("http://a/3") != nil || cache.Get("http://b/1") == nil {
+		t.Error("only entries with the prefix should be purged")
+	}
+	if res := cache.Purge(""); res != 1 || cache.Stats().Size != 0 {
+		t.Error("empty prefix should purge all")
+	}
+}
+
+func TestMemoryCacheConcurrency(t *testing.T) {
+	cache := newMemoryCache(10000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := string(rune('a' + (i + j) % 20))
+				if cache.Get(key) == nil {
+					cache.Put(key, &cacheEntry{header: http.Header{}, data: make([]byte, 1000)})
+				}
+				if j % 50 == 0 {
+					cache.Purge(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	if stats.Size > 10000 || stats.Hits + stats.Misses != 1600 {
+		t.Errorf("counters not as expected: %+v", stats)
+	}
+}
+
+func TestDiskCachePurge(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	cache, err := newDiskCache(cachePath, 10000)
+	if err != nil {
+		t.Fatal("Cannot create disk cache")
+	}
+	for _, key := range []string{"http://a/1", "http://a/2", "http://b/1"} {
+		cache.Put(key, &cacheEntry{header: http.Header{}, data: []byte(key)})
+	}
+
+	// keys are loaded on restart
+	cache, err = newDiskCache(cachePath, 10000)
+	if err != nil {
+		t.Fatal("Cannot reopen disk cache")
+	}
+	if res := cache.Purge("http://a/"); res != 2 {
+		t.Errorf("2 entries should be purged, got %d", res)
+	}
+	if cache.Get("http://a/1") != nil || cache.Get("http://b/1") == nil {
+		t.Error("only entries with the prefix should be purged")
+	}
+	if files, _ := ioutil.ReadDir(cachePath); len(files) != 1 {
+		t.Error("purged entries should be deleted from the disk")
+	}
+}
+
+func TestThumbnailHandlerMemoryCache(t *testing.T) {
+	initTestManager(t)
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	diskCache, err := newDiskCache(cachePath, 1 << 20)
+	if err != nil {
+		t.Fatal("Cannot create disk cache")
+	}
+	gServiceManager.diskCache = diskCache
+	gServiceManager.memoryCache = newMemoryCache(1 << 20)
+	defer func() { gServiceManager.diskCache, gServiceManager.memoryCache = nil, nil }()
+
+	var count int32
+	server := newTestCountingServer(newTestGradientImage(400, 200), imaging.PNG, &count)
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100"
+
+	if w := requestThumbnail(query, "", &CommonServiceConfig{}); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatal("first request should miss")
+	}
+
+	// served from memory, even when the disk entry is gone
+	diskCache.Purge("")
+	if w := requestThumbnail(query, "", &CommonServiceConfig{}); w.Header().Get("X-Cache") != "HIT" || w.Body.Len() == 0 {
+		t.Error("second request should hit the memory cache")
+	}
+
+	// disk hit is promoted to memory
+	gServiceManager.memoryCache.Purge("")
+	requestThumbnail(query + "&format=gif", "", &CommonServiceConfig{})
+	gServiceManager.memoryCache.Purge("")
+	if w := requestThumbnail(query + "&format=gif", "", &CommonServiceConfig{}); w.Header().Get("X-Cache") != "HIT" {
+		t.Error("request should hit the disk cache")
+	}
+	if gServiceManager.memoryCache.Stats().Entries != 1 {
+		t.Error("disk hit should be kept in memory")
+	}
+
+	if atomic.LoadInt32(&count) != 2 {
+		t.Error("cache hits should not download the source")
+	}
+}
+
+func TestCacheAdminHandler(t *testing.T) {
+	initTestManager(t)
+	gServiceManager.memoryCache = newMemoryCache(1 << 20)
+	defer func() { gServiceManager.memoryCache = nil }()
+
+	gServiceManager.memoryCache.Put("http://a/1 w=1", &cacheEntry{header: http.Header{}, data: []byte("a")})
+	gServiceManager.memoryCache.Put("http://b/1 w=1", &cacheEntry{header: http.Header{}, data: []byte("b")})
+
+	config := &CommonServiceConfig{Path: "/cache", Token: "secret"}
+	request := func(method string, query string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/cache?" + query, nil)
+		if token != "" {
+			r.Header.Set("X-Admin-Token", token)
+		}
+		w := httptest.NewRecorder()
+		cacheAdminHandler(w, r, config)
+		return w
+	}
+
+	if w := request("GET", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Error("token should be required")
+	}
+
+	w := request("GET", "", "secret")
+	var stats cacheStatsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("stats should be json")
+	}
+	if stats.Memory == nil || stats.Memory.Entries != 2 || stats.Disk != nil {
+		t.Error("stats not as expected")
+	}
+
+	if w := request("POST", "", "secret"); w.Code != http.StatusBadRequest {
+		t.Error("purge should require prefix")
+	}
+
+	w = request("DELETE", "prefix=" + url.QueryEscape("http://a/"), "secret")
+	var purged cachePurgeResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &purged); err != nil || purged.Memory != 1 || purged.Disk != 0 {
+		t.Error("purge response not as expected")
+	}
+	if gServiceManager.memoryCache.Get("http://b/1 w=1") == nil {
+		t.Error("only entries with the prefix should be purged")
+	}
+
+	if w := request("PUT", "", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Error("method should be validated")
+	}
+
+	// no token configured, closed
+	config = &CommonServiceConfig{Path: "/cache"}
+	if w := request("DELETE", "prefix=", ""); w.Code != http.StatusUnauthorized || gServiceManager.memoryCache.Get("http://b/1 w=1") == nil {
+		t.Error("admin service without token should refuse requests")
+	}
+	if err := registerCacheAdmin(config); err == nil {
+		t.Error("admin service without token should not be registered")
+	}
+	if err := registerMetrics(&CommonServiceConfig{Path: "/metrics"}); err == nil {
+		t.Error("metrics service without token should not be registered")
+	}
+}
+
+func TestIsSourceFresh(t *testing.T) {
+	now := time.Now()
+	stored := now.Add(-time.Minute).UTC().Format(http.TimeFormat)
+
+	for _, test := range []struct {
+		header map[string]string
+		expected bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{sourceCacheDateHeader: stored}, false},
+		{map[string]string{sourceCacheDateHeader: stored, "ETag": "\"1\""}, false},
+		{map[string]string{sourceCacheDateHeader: stored, "Cache-Control": "public, max-age=3600"}, true},
+		{map[string]string{sourceCacheDateHeader: stored, "Cache-Control": "max-age=30"}, false},
+		{map[string]string{sourceCacheDateHeader: stored, "Cache-Control": "max-age=3600, s-maxage=30"}, false},
+		{map[string]string{sourceCacheDateHeader: stored, "Cache-Control": "no-cache, max-age=3600"}, false},
+		{map[string]string{sourceCacheDateHeader: stored, "Cache-Control": "max-age=abc"}, false},
+		{map[string]string{sourceCacheDateHeader: stored, "Expires": now.Add(time.Hour).UTC().Format(http.TimeFormat)}, true},
+		{map[string]string{sourceCacheDateHeader: stored, "Expires": now.Add(-time.Hour).UTC().Format(http.TimeFormat)}, false},
+		{map[string]string{sourceCacheDateHeader: stored, "Expires": "0"}, false},
+		{map[string]string{"Cache-Control": "max-age=3600"}, false},
+	} {
+		header := http.Header{}
+		for name, value := range test.header {
+			header.Set(name, value)
+		}
+		if res := isSourceFresh(header, now); res != test.expected {
+			t.Errorf("freshness of %v should be %t", test.header, test.expected)
+		}
+	}
+}
+
+func TestIsSourceCacheable(t *testing.T) {
+	for _, test := range []struct {
+		header map[string]string
+		expected bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"ETag": "\"1\""}, true},
+		{map[string]string{"Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"}, true},
+		{map[string]string{"Cache-Control": "max-age=60"}, true},
+		{map[string]string{"Expires": "Mon, 02 Jan 2006 15:04:05 GMT"}, true},
+		{map[string]string{"ETag": "\"1\"", "Cache-Control": "no-store"}, false},
+	} {
+		header := http.Header{}
+		for name, value := range test.header {
+			header.Set(name, value)
+		}
+		if res := isSourceCacheable(header); res != test.expected {
+			t.Errorf("cacheable of %v should be %t", test.header, test.expected)
+		}
+	}
+}
+
+func TestFetchSource(t *testing.T) {
+	initTestManager(t)
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	data := bytes.Repeat([]byte("source"), 100)
+	spoolPath := filepath.Join(cachePath, "spool")
+
+	for _, test := range []struct {
+		name string
+		header map[string]string
+		requests int32
+		downloads int32
+	}{
+		{"etag", map[string]string{"ETag": "\"v1\""}, 5, 1},
+		{"last-modified", map[string]string{"Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT"}, 5, 1},
+		{"fresh", map[string]string{"ETag": "\"v1\"", "Cache-Control": "max-age=3600"}, 1, 1},
+		{"no-cache", map[string]string{"ETag": "\"v1\"", "Cache-Control": "no-cache"}, 5, 1},
+		{"no-store", map[string]string{"ETag": "\"v1\"", "Cache-Control": "no-store"}, 5, 5},
+		{"no validators", map[string]string{}, 5, 5},
+	} {
+		cache, err := newDiskCache(filepath.Join(cachePath, test.name), 1 << 20)
+		if err != nil {
+			t.Fatal("Cannot create source cache")
+		}
+
+		header := http.Header{}
+		for name, value := range test.header {
+			header.Set(name, value)
+		}
+
+		var requests, downloads int32
+		server := newTestRevalidationServer(data, header, &requests, &downloads)
+
+		// small threshold, spooled sources are cached too
+		for i, threshold := range []int64{1000, 1000, 10, 1000, 10} {
+			src, err := fetchSource(cache, &sourceRequest{url: server.URL + "/image.jpg"}, spoolPath, threshold)
+			if err != nil {
+				t.Fatalf("%s: fetch %d should succeed", test.name, i)
+			}
+			if res, _ := ioutil.ReadAll(src); bytes.Equal(res, data) == false {
+				t.Errorf("%s: fetch %d data not as expected", test.name, i)
+			}
+			if src.lastModified.Format(http.TimeFormat) != header.Get("Last-Modified") && header.Get("Last-Modified") != "" {
+				t.Errorf("%s: fetch %d Last-Modified not as expected", test.name, i)
+			}
+			src.Close()
+		}
+		server.Close()
+
+		if requests != test.requests || downloads != test.downloads {
+			t.Errorf("%s: expected %d requests and %d downloads, got %d and %d", test.name, test.requests, test.downloads, requests, downloads)
+		}
+		if _, err := os.Stat(spoolPath); err == nil {
+			t.Errorf("%s: spool file should be deleted", test.name)
+		}
+	}
+}
+
+func TestFetchSourceModified(t *testing.T) {
+	initTestManager(t)
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	cache, err := newDiskCache(cachePath, 1 << 20)
+	if err != nil {
+		t.Fatal("Cannot create source cache")
+	}
+
+	version := "v1"
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		w.Header().Set("ETag", version)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(version))
+	}))
+	defer server.Close()
+
+	fetch := func() string {
+		src, err := fetchSource(cache, &sourceRequest{url: server.URL}, "", 1000)
+		if err != nil {
+			t.Fatal("fetch should succeed")
+		}
+		defer src.Close()
+		res, _ := ioutil.ReadAll(src)
+		return string(res)
+	}
+
+	if fetch() != "v1" || fetch() != "v1" {
+		t.Error("first version should be fetched")
+	}
+
+	mutex.Lock()
+	version = "v2"
+	mutex.Unlock()
+
+	if fetch() != "v2" || fetch() != "v2" {
+		t.Error("modified source should replace the cached source")
+	}
+
+	// not found is not cached
+	if src, err := fetchSource(cache, &sourceRequest{url: server.URL + "/missing?x"}, "", 1000); err == nil {
+		src.Close()
+	}
+	if cache.Get(sourceCacheKey(&sourceRequest{url: server.URL + "/missing?x"})) != nil {
+		t.Error("error responses should not be cached")
+	}
+}
+
+func TestThumbnailHandlerSourceCache(t *testing.T) {
+	initTestManager(t)
+	cachePath, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal("Cannot create cache path")
+	}
+	defer os.RemoveAll(cachePath)
+
+	cache, err := newDiskCache(cachePath, 1 << 20)
+	if err != nil {
+		t.Fatal("Cannot create source cache")
+	}
+	gServiceManager.sourceCache = cache
+	defer func() { gServiceManager.sourceCache = nil }()
+
+	var buf bytes.Buffer
+	imaging.Encode(&buf, newTestGradientImage(400, 200), imaging.PNG)
+	header := http.Header{}
+	header.Set("ETag", "\"gradient\"")
+
+	var requests, downloads int32
+	server := newTestRevalidationServer(buf.Bytes(), header, &requests, &downloads)
+	defer server.Close()
+
+	// five sizes of the same image
+	for _, width := range []string{"50", "100", "150", "200", "250"} {
+		w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/image.png") + "&width=" + width, "", &CommonServiceConfig{})
+		if img, _, err := image.DecodeConfig(w.Body); err != nil || strconv.Itoa(img.Width) != width {
+			t.Error("thumbnail of width " + width + " not as expected")
+		}
+	}
+
+	if downloads != 1 || requests != 5 {
+		t.Errorf("source should be downloaded once and revalidated, got %d downloads %d requests", downloads, requests)
+	}
+}
+
+func TestThumbnailCacheControl(t *testing.T) {
+	for _, test := range []struct {
+		config CommonServiceConfig
+		expected string
+	}{
+		{CommonServiceConfig{}, ""},
+		{CommonServiceConfig{Immutable: true}, ""},
+		{CommonServiceConfig{MaxAge: 3600}, "public, max-age=3600"},
+		{CommonServiceConfig{MaxAge: 31536000, Immutable: true}, "public, max-age=31536000, immutable"},
+	} {
+		if res := thumbnailCacheControl(&test.config); res != test.expected {
+			t.Error("Cache-Control should be " + test.expected + ", got " + res)
+		}
+	}
+
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/maxage", MaxAge: -1}); err == nil {
+		t.Error("negative maxage should not be valid")
+	}
+}
+
+func TestThumbnailHandlerConditional(t *testing.T) {
+	initTestManager(t)
+	srcImg := newTestGradientImage(400, 200)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		imaging.Encode(w, srcImg, imaging.PNG)
+	}))
+	defer server.Close()
+
+	config := &CommonServiceConfig{MaxAge: 3600, Immutable: true}
+	query := "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100"
+
+	request := func(header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/thumbnail?" + query, nil)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		thumbnailHandler(w, r, config)
+		return w
+	}
+
+	w := request(nil)
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || len(etag) != 34 || etag[0] != '"' || lastModified != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Fatal("thumbnail should have strong ETag and the source Last-Modified")
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=3600, immutable" || w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Error("thumbnail headers not as expected")
+	}
+
+	// same output bytes, same ETag
+	if res := request(nil).Header().Get("ETag"); res != etag {
+		t.Error("ETag should be derived from the output")
+	}
+	if res := request(map[string]string{"Accept": "image/png"}); res.Header().Get("ETag") != etag {
+		t.Error("ETag should not depend on the request")
+	}
+
+	for _, test := range []struct {
+		header map[string]string
+		expected int
+	}{
+		{map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": "\"other\", " + etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": "\"other\""}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:04 GMT"}, http.StatusOK},
+		{map[string]string{"If-None-Match": "\"other\"", "If-Modified-Since": lastModified}, http.StatusOK},
+	} {
+		w := request(test.header)
+		if w.Code != test.expected {
+			t.Errorf("conditional request %v should be %d, got %d", test.header, test.expected, w.Code)
+		}
+		if w.Code == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != etag || w.Header().Get("Cache-Control") == "") {
+			t.Errorf("not modified response %v not as expected", test.header)
+		}
+	}
+
+	// errors are not cacheable
+	if w := requestThumbnail("width=100", "", config); w.Header().Get("Cache-Control") != "" {
+		t.Error("error response should not have Cache-Control")
+	}
+}
+
+func TestThumbnailHandlerConditionalCached(t *testing.T) {
+	initTestManager(t)
+	gServiceManager.memoryCache = newMemoryCache(1 << 20)
+	defer func() { gServiceManager.memoryCache = nil }()
+
+	server := newTestImageServer(newTestGradientImage(400, 200), imaging.PNG)
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100"
+	miss := requestThumbnail(query, "", &CommonServiceConfig{})
+
+	r := httptest.NewRequest("GET", "/thumbnail?" + query, nil)
+	r.Header.Set("If-None-Match", miss.Header().Get("ETag"))
+	w := httptest.NewRecorder()
+	thumbnailHandler(w, r, &CommonServiceConfig{})
+	if w.Code != http.StatusNotModified || w.Header().Get("X-Cache") != "HIT" || w.Header().Get("ETag") != miss.Header().Get("ETag") {
+		t.Error("cached thumbnail should keep its validators")
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var group flightGroup
+	var calls int32
+	release := make(chan struct{})
+
+	fn := func() *thumbnailResult {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &thumbnailResult{entry: &cacheEntry{data: []byte("a")}}
+	}
+
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, isShared := group.Do("a", fn)
+			if result.entry == nil || string(result.entry.data) != "a" {
+				t.Error("every caller should receive the result")
+			}
+			if isShared {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+
+	waitFor(t, func() bool { return group.waiting("a") == 9 })
+	close(release)
+	wg.Wait()
+
+	if calls != 1 || shared != 9 {
+		t.Errorf("fn should run once, got %d calls %d shared", calls, shared)
+	}
+
+	// done computations are not shared
+	if _, isShared := group.Do("a", fn); isShared || calls != 2 {
+		t.Error("later call should run fn again")
+	}
+
+	// nil result
+	if result, _ := group.Do("b", func() *thumbnailResult { return nil }); result.err == nil || errorStatus(result.err) != http.StatusInternalServerError {
+		t.Error("nil result should be an error")
+	}
+}
+
+// wait until condition is true, fail after a timeout
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not reached")
+}
+
+func TestThumbnailHandlerCoalescing(t *testing.T) {
+	initTestManager(t)
+
+	var buf bytes.Buffer
+	imaging.Encode(&buf, newTestGradientImage(400, 200), imaging.PNG)
+
+	var count int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		<-release // hold the computation until all the requests are waiting
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	const requests = 50
+	query := "url=" + url.QueryEscape(server.URL + "/avatar.png") + "&width=64&height=64"
+	params, err := fillThumbnailParams(parseQuery(t, query), &CommonServiceConfig{})
+	if err != nil {
+		t.Fatal("params should be valid")
+	}
+	key := thumbnailCacheKey(params)
+
+	responses := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = requestThumbnail(query, "", &CommonServiceConfig{})
+		}(i)
+	}
+
+	waitFor(t, func() bool { return gServiceManager.flights.waiting(key) == requests - 1 })
+	close(release)
+	wg.Wait()
+
+	if count != 1 {
+		t.Errorf("origin should be hit once, got %d", count)
+	}
+	for i, w := range responses {
+		if w.Code != http.StatusOK || bytes.Equal(w.Body.Bytes(), responses[0].Body.Bytes()) == false {
+			t.Errorf("response %d should be the shared thumbnail", i)
+		}
+	}
+
+	// download error
+	server.Close()
+	if w := requestThumbnail(query, "", &CommonServiceConfig{}); w.Code != http.StatusBadGateway {
+		t.Error("download error should be returned")
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(2, 1, 50 * time.Millisecond)
+
+	if pool.Acquire() != nil || pool.Acquire() != nil {
+		t.Fatal("workers should be acquired")
+	}
+
+	// queued, released by a worker
+	acquired := make(chan error)
+	go func() { acquired <- pool.Acquire() }()
+	waitFor(t, func() bool { return pool.Stats().Queued == 1 })
+
+	// queue full
+	if err := pool.Acquire(); err != errPoolSaturated {
+		t.Error("full queue should reject")
+	}
+
+	pool.Release()
+	if err := <-acquired; err != nil {
+		t.Error("queued request should get the released worker")
+	}
+
+	// wait timeout
+	if err := pool.Acquire(); err != errPoolSaturated {
+		t.Error("wait should time out")
+	}
+
+	stats := pool.Stats()
+	if stats.Workers != 2 || stats.Running != 2 || stats.Queued != 0 || stats.QueueSize != 1 || stats.PeakQueued != 1 ||
+		stats.Rejected != 1 || stats.TimedOut != 1 {
+		t.Errorf("counters not as expected: %+v", stats)
+	}
+
+	pool.Release()
+	pool.Release()
+	if pool.Stats().Running != 0 {
+		t.Error("workers should be released")
+	}
+
+	if res := retryAfterSeconds(pool.timeout); res != 1 {
+		t.Errorf("retry after should be rounded up to 1 second, got %d", res)
+	}
+	if res := retryAfterSeconds(2500 * time.Millisecond); res != 3 {
+		t.Errorf("retry after should be 3 seconds, got %d", res)
+	}
+}
+
+func TestThumbnailHandlerPool(t *testing.T) {
+	initTestManager(t)
+	pool := newWorkerPool(1, 1, 10 * time.Millisecond)
+	gServiceManager.pool = pool
+	defer func() { gServiceManager.pool = nil }()
+
+	server := newTestImageServer(newTestImage(400, 200), imaging.PNG)
+	defer server.Close()
+
+	query := "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100"
+
+	// saturated
+	pool.Acquire()
+	w := requestThumbnail(query, "", &CommonServiceConfig{})
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Error("saturated pool should answer 503 with Retry-After")
+	}
+	pool.Release()
+
+	if w := requestThumbnail(query, "", &CommonServiceConfig{}); w.Code != http.StatusOK {
+		t.Error("available worker should resize")
+	}
+	if stats := pool.Stats(); stats.Running != 0 || stats.TimedOut != 1 {
+		t.Errorf("counters not as expected: %+v", stats)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	initTestManager(t)
+	gServiceManager.pool = newWorkerPool(3, 12, time.Second)
+	gServiceManager.pixels = newPixelBudget(1000, time.Second)
+	defer func() { gServiceManager.pool, gServiceManager.pixels = nil, nil }()
+
+	config := &CommonServiceConfig{Path: "/metrics", Token: "secret"}
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	metricsHandler(w, r, config)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("token should be required")
+	}
+
+	r.Header.Set("X-Admin-Token", "secret")
+	w = httptest.NewRecorder()
+	metricsHandler(w, r, config)
+
+	var metrics metricsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("metrics should be json")
+	}
+	if metrics.Pool == nil || metrics.Pool.Workers != 3 || metrics.Pool.QueueSize != 12 {
+		t.Error("pool metrics not as expected")
+	}
+	if metrics.Pixels == nil || metrics.Pixels.Budget != 1000 {
+		t.Error("pixel budget metrics not as expected")
+	}
+}
+
+func TestInitPool(t *testing.T) {
+	manager := &serviceManager{}
+	if err := manager.initPool(); err != nil || manager.pool == nil {
+		t.Fatal("default pool should be created")
+	}
+	if stats := manager.pool.Stats(); stats.Workers < 1 || stats.QueueSize != stats.Workers * workerPoolDefaultQueueFactor ||
+		manager.pool.timeout != workerPoolDefaultTimeout {
+		t.Error("default pool not as expected")
+	}
+
+	manager.config.Workers = -1
+	if err := manager.initPool(); err == nil {
+		t.Error("negative workers should not be valid")
+	}
+}
+
+// png header of a width x height image, without image data (decompression bomb)
+func newTestPngHeader(width uint32, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // rgba
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = append(data, 0, 0, 0, 13)
+	data = append(data, ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ihdr))
+	return append(data, crc...)
+}
+
+// serve data
+func newTestDataServer(data []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+}
+
+func TestThumbnailHandlerMaxSourcePixels(t *testing.T) {
+	initTestManager(t)
+
+	// decompression bomb, rejected by the header
+	bomb := newTestDataServer(newTestPngHeader(100000, 100000))
+	defer bomb.Close()
+	if w := requestThumbnail("url=" + url.QueryEscape(bomb.URL) + "&width=100", "", &CommonServiceConfig{}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("image above the default limit should be 413, got %d", w.Code)
+	}
+
+	// no size
+	empty := newTestDataServer([]byte("GIF89a\x00\x00\x00\x00\x00\x00\x00"))
+	defer empty.Close()
+	if w := requestThumbnail("url=" + url.QueryEscape(empty.URL) + "&width=100", "", &CommonServiceConfig{}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("image without size should be 422, got %d", w.Code)
+	}
+
+	server := newTestImageServer(newTestImage(400, 200), imaging.PNG)
+	defer server.Close()
+	query := "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100"
+
+	if w := requestThumbnail(query, "", &CommonServiceConfig{MaxSourcePixels: 80000}); w.Code != http.StatusOK {
+		t.Error("image at the limit should be resized")
+	}
+	if w := requestThumbnail(query, "", &CommonServiceConfig{MaxSourcePixels: 79999}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("image above the service limit should be 413")
+	}
+
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/maxsourcepixels", MaxSourcePixels: -1}); err == nil {
+		t.Error("negative maxsourcepixels should not be valid")
+	}
+}
+
+func TestPixelBudget(t *testing.T) {
+	budget := newPixelBudget(100, 50 * time.Millisecond)
+
+	if budget.Acquire(101) != errPixelBudgetExceeded {
+		t.Error("image bigger than the budget should never fit")
+	}
+
+	if budget.Acquire(60) != nil {
+		t.Fatal("pixels should be acquired")
+	}
+
+	// waits for released pixels
+	acquired := make(chan error)
+	go func() { acquired <- budget.Acquire(60) }()
+	waitFor(t, func() bool { return budget.Stats().Waiting == 1 })
+	budget.Release(60)
+	if err := <-acquired; err != nil {
+		t.Error("waiting request should get the released pixels")
+	}
+
+	// timeout
+	if budget.Acquire(50) != errPoolSaturated {
+		t.Error("wait should time out")
+	}
+	if budget.Acquire(40) != nil {
+		t.Error("pixels left should be acquired")
+	}
+
+	stats := budget.Stats()
+	if stats.Budget != 100 || stats.InUse != 100 || stats.Waiting != 0 || stats.TimedOut != 1 {
+		t.Errorf("counters not as expected: %+v", stats)
+	}
+}
+
+func TestThumbnailHandlerPixelBudget(t *testing.T) {
+	initTestManager(t)
+	budget := newPixelBudget(100000, 10 * time.Millisecond)
+	gServiceManager.pixels = budget
+	defer func() { gServiceManager.pixels = nil }()
+
+	small := newTestImageServer(newTestImage(400, 200), imaging.PNG)
+	defer small.Close()
+	big := newTestImageServer(newTestImage(400, 400), imaging.PNG)
+	defer big.Close()
+
+	if w := requestThumbnail("url=" + url.QueryEscape(big.URL) + "&width=100", "", &CommonServiceConfig{}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("image bigger than the budget should be 413")
+	}
+
+	// budget used by other requests
+	budget.Acquire(50000)
+	w := requestThumbnail("url=" + url.QueryEscape(small.URL) + "&width=100", "", &CommonServiceConfig{})
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Error("exhausted budget should be 503 with Retry-After")
+	}
+	budget.Release(50000)
+
+	if w := requestThumbnail("url=" + url.QueryEscape(small.URL) + "&width=100", "", &CommonServiceConfig{}); w.Code != http.StatusOK {
+		t.Error("image within the budget should be resized")
+	}
+	if budget.Stats().InUse != 0 {
+		t.Error("pixels should be released")
+	}
+}
+
+func TestThumbnailHandlerMaxOutput(t *testing.T) {
+	initTestManager(t)
+
+	tiny := newTestImageServer(newTestImage(10, 10), imaging.PNG)
+	defer tiny.Close()
+	line := newTestImageServer(newTestImage(3000, 1), imaging.PNG)
+	defer line.Close()
+
+	tests := []struct {
+		name string
+		query string
+		config *CommonServiceConfig
+		status int
+	}{
+		{"requested width", "url=" + url.QueryEscape(tiny.URL) + "&width=40000&height=40000", &CommonServiceConfig{}, http.StatusBadRequest},
+		{"requested bounding height", "url=" + url.QueryEscape(tiny.URL) + "&maxh=8193", &CommonServiceConfig{}, http.StatusBadRequest},
+		{"derived width", "url=" + url.QueryEscape(line.URL) + "&height=8000", &CommonServiceConfig{}, http.StatusRequestEntityTooLarge},
+		{"device pixel ratio", "url=" + url.QueryEscape(tiny.URL) + "&width=8000&height=8000&dpr=2&dprupscale=true", &CommonServiceConfig{MaxDpr: 3, DprUpscale: true}, http.StatusRequestEntityTooLarge},
+		{"pixels", "url=" + url.QueryEscape(tiny.URL) + "&width=8000&height=8000", &CommonServiceConfig{}, http.StatusRequestEntityTooLarge},
+		{"service pixels", "url=" + url.QueryEscape(tiny.URL) + "&width=100&height=100", &CommonServiceConfig{MaxOutputPixels: 9999}, http.StatusRequestEntityTooLarge},
+		{"service width", "url=" + url.QueryEscape(tiny.URL) + "&width=101", &CommonServiceConfig{MaxOutputWidth: 100}, http.StatusBadRequest},
+		{"within limits", "url=" + url.QueryEscape(tiny.URL) + "&width=100&height=100", &CommonServiceConfig{MaxOutputPixels: 10000}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if w := requestThumbnail(test.query, "", test.config); w.Code != test.status {
+			t.Errorf("%s: status should be %d, got %d %s", test.name, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	// thumbnail pixels are counted in the budget
+	gServiceManager.pixels = newPixelBudget(20000, 10 * time.Millisecond)
+	defer func() { gServiceManager.pixels = nil }()
+	if w := requestThumbnail("url=" + url.QueryEscape(tiny.URL) + "&width=200&height=200", "", &CommonServiceConfig{}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("thumbnail bigger than the budget should be 413")
+	}
+
+	if err := registerThumbnail(&CommonServiceConfig{Path: "/maxoutput", MaxOutputPixels: -1}); err == nil {
+		t.Error("negative maxoutputpixels should not be valid")
+	}
+}
+
+func TestThumbnailHandlerIntermediateMemory(t *testing.T) {
+	initTestManager(t)
+
+	thin := newTestImageServer(newTestImage(1, 300), imaging.PNG)
+	defer thin.Close()
+	wide := newTestImageServer(newTestImage(300, 1), imaging.PNG)
+	defer wide.Close()
+
+	// budget of the source and one 2000x2000 thumbnail
+	budget := newPixelBudget(2000 * 2000 + 300, 10 * time.Millisecond)
+	gServiceManager.pixels = budget
+	defer func() { gServiceManager.pixels = nil }()
+
+	for _, test := range []struct {
+		name string
+		query string
+		status int
+	}{
+		{"thin cover", "url=" + url.QueryEscape(thin.URL) + "&fit=cover&width=2000&height=2000", http.StatusOK},
+		{"wide cover", "url=" + url.QueryEscape(wide.URL) + "&fit=cover&width=2000&height=2000", http.StatusOK},
+		{"thin blur", "url=" + url.QueryEscape(thin.URL) + "&bg=blur&width=2000&height=2000", http.StatusOK},
+		{"wide blur", "url=" + url.QueryEscape(wide.URL) + "&bg=blur&width=2000&height=2000", http.StatusOK},
+		{"over budget", "url=" + url.QueryEscape(thin.URL) + "&fit=cover&width=2001&height=2000", http.StatusRequestEntityTooLarge},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		w := requestThumbnail(test.query + "&format=jpeg", "", &CommonServiceConfig{})
+		runtime.ReadMemStats(&after)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status should be %d, got %d", test.name, test.status, w.Code)
+		}
+
+		// a few thumbnail sized images (4 bytes a pixel), not the source covering the whole thumbnail
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16 * 2000 * 2000 * 4 {
+			t.Errorf("%s: allocated %d bytes", test.name, allocated)
+		}
+	}
+
+	if budget.Stats().InUse != 0 {
+		t.Error("pixels should be released")
+	}
+}
+
+func TestSourceFetcherIsBlocked(t *testing.T) {
+	fetcher, err := newSourceFetcher(FetchConfig{AllowNetworks: []string{"10.1.0.0/16", "fd00::1"}, DenyNetworks: []string{"10.1.2.0/24", "93.184.216.34"}})
+	if err != nil {
+		t.Fatal("Cannot create fetcher")
+	}
+
+	for _, test := range []struct {
+		ip string
+		expected bool
+	}{
+		{"169.254.169.254", true},
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"ff02::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		// embedded ipv4: nat64, 6to4 and ipv4 compatible
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b::169.254.169.254", true},
+		{"64:ff9b::808:808", false},
+		{"2002:a00:1::1", true},
+		{"2002:7f00:1::", true},
+		{"2002:808:808::1", false},
+		{"::127.0.0.1", true},
+		{"::10.0.0.1", true},
+		{"::8.8.8.8", false},
+		{"64:ff9b::a01:1", false}, // allowed ipv4
+		{"2002:a01:203::1", true}, // denied ipv4
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+		{"172.32.0.1", false},
+		// allow list
+		{"10.1.0.1", false},
+		{"fd00::1", false},
+		{"fd00::2", true},
+		// deny list wins
+		{"10.1.2.3", true},
+		{"93.184.216.34", true},
+	} {
+		if res := fetcher.isBlocked(net.ParseIP(test.ip)); res != test.expected {
+			t.Errorf("%s blocked should be %t", test.ip, test.expected)
+		}
+	}
+
+	for _, network := range []string{"10.0.0.0/33", "abc", "300.1.1.1"} {
+		if _, err := newSourceFetcher(FetchConfig{DenyNetworks: []string{network}}); err == nil {
+			t.Error("network " + network + " should not be valid")
+		}
+	}
+}
+
+// listen on address, the test is skipped when the address is not available
+func newTestListenerServer(t *testing.T, address string, handler http.Handler) *httptest.Server {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skip("cannot listen on " + address)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	return server
+}
+
+func TestSourceFetcher(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		switch r.URL.Path {
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	isError := func(err error, expected error) bool {
+		return err != nil && strings.Contains(err.Error(), expected.Error())
+	}
+
+	// loopback blocked by default
+	fetcher, _ := newSourceFetcher(FetchConfig{})
+	if _, err := fetcher.Get(server.URL); isError(err, errFetchBlocked) == false || count != 0 {
+		t.Error("loopback should be blocked by default")
+	}
+
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.1"}})
+	if resp, err := fetcher.Get(server.URL); err != nil || resp.StatusCode != http.StatusOK {
+		t.Error("allowed address should be fetched")
+	} else {
+		resp.Body.Close()
+	}
+
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.0/8"}, DenyNetworks: []string{"127.0.0.1/32"}})
+	if _, err := fetcher.Get(server.URL); isError(err, errFetchBlocked) == false {
+		t.Error("denied address should be blocked")
+	}
+
+	// schemes
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.1"}})
+	for _, rawUrl := range []string{"ftp://127.0.0.1/image.jpg", "file:///etc/passwd", "gopher://127.0.0.1"} {
+		if _, err := fetcher.Get(rawUrl); err != errFetchScheme {
+			t.Error("scheme should be blocked: " + rawUrl)
+		}
+	}
+	if _, err := fetcher.Get(server.URL + "/file"); isError(err, errFetchScheme) == false {
+		t.Error("redirect scheme should be checked")
+	}
+	if _, err := fetcher.Get(server.URL + "/loop"); err == nil {
+		t.Error("redirect loop should stop")
+	}
+}
+
+func TestSourceFetcherRedirect(t *testing.T) {
+	var internalCount int32
+	internal := newTestListenerServer(t, "127.0.0.2:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&internalCount, 1)
+		w.Write([]byte("secret"))
+	}))
+	defer internal.Close()
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL + "/admin", http.StatusFound)
+	}))
+	defer public.Close()
+
+	// only the "public" server is allowed, the redirect target is checked again
+	fetcher, _ := newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.1"}})
+	if _, err := fetcher.Get(public.URL); err == nil || strings.Contains(err.Error(), errFetchBlocked.Error()) == false {
+		t.Error("redirect to a blocked address should be refused")
+	}
+	if internalCount != 0 {
+		t.Error("blocked address should not be connected")
+	}
+
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.1", "127.0.0.2"}})
+	if resp, err := fetcher.Get(public.URL); err != nil || resp.StatusCode != http.StatusOK {
+		t.Error("redirect to an allowed address should be followed")
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestThumbnailHandlerBlockedSource(t *testing.T) {
+	initTestManager(t)
+	fetcher := gServiceManager.fetcher
+	gServiceManager.fetcher, _ = newSourceFetcher(FetchConfig{})
+	defer func() { gServiceManager.fetcher = fetcher }()
+
+	var count int32
+	server := newTestCountingServer(newTestImage(400, 200), imaging.PNG, &count)
+	defer server.Close()
+
+	for _, rawUrl := range []string{server.URL + "/image.png", "file:///etc/passwd", "http://169.254.169.254/latest/meta-data/"} {
+		if w := requestThumbnail("url=" + url.QueryEscape(rawUrl) + "&width=100", "", &CommonServiceConfig{}); w.Code == http.StatusOK {
+			t.Error("blocked source should not be fetched: " + rawUrl)
+		}
+	}
+	if count != 0 {
+		t.Error("loopback source should not be connected")
+	}
+}
+
+func TestHostPolicy(t *testing.T) {
+	hosts := newHostPolicy(&CommonServiceConfig{AllowHosts: []string{"images.example.com", "*.cdn.example.com"}, DenyHosts: []string{"private.cdn.example.com"}})
+
+	for _, test := range []struct {
+		host string
+		expected bool
+	}{
+		{"images.example.com", true},
+		{"IMAGES.example.com.", true},
+		{"a.cdn.example.com", true},
+		{"a.b.cdn.example.com", true},
+		{"cdn.example.com", false},
+		{"evilcdn.example.com", false},
+		{"example.com", false},
+		{"images.example.com.evil.com", false},
+		{"private.cdn.example.com", false},
+	} {
+		if res := hosts.isAllowed(test.host); res != test.expected {
+			t.Errorf("host %s allowed should be %t", test.host, test.expected)
+		}
+	}
+
+	// deny list only
+	hosts = newHostPolicy(&CommonServiceConfig{DenyHosts: []string{"*.internal"}})
+	if hosts.isAllowed("a.internal") || hosts.isAllowed("example.com") == false {
+		t.Error("deny list only should permit all other hosts")
+	}
+
+	if newHostPolicy(&CommonServiceConfig{}) != nil || (*hostPolicy)(nil).isAllowed("example.com") == false {
+		t.Error("no lists should permit all hosts")
+	}
+
+	for _, pattern := range []string{"", "*.", "a*.example.com", "example.com:80", "http://example.com"} {
+		if isHostPatternValid(pattern) {
+			t.Error("host pattern should not be valid: " + pattern)
+		}
+	}
+}
+
+func TestOriginUrl(t *testing.T) {
+	for _, test := range []struct {
+		base string
+		path string
+		expected string
+	}{
+		{"https://cdn.example.com/images/", "/a/b.jpg", "https://cdn.example.com/images/a/b.jpg"},
+		{"https://cdn.example.com/images", "a/b.jpg", "https://cdn.example.com/images/a/b.jpg"},
+		{"https://cdn.example.com", "/a/b.jpg", "https://cdn.example.com/a/b.jpg"},
+		{"https://cdn.example.com/images/", "/../../etc/passwd", "https://cdn.example.com/images/etc/passwd"},
+		{"https://cdn.example.com/images/", "a b.jpg", "https://cdn.example.com/images/a%20b.jpg"},
+	} {
+		if res, err := originUrl(OriginConfig{Url: test.base}, test.path); err != nil || res != test.expected {
+			t.Error("origin url should be " + test.expected + ", got " + res)
+		}
+	}
+
+	header := originHeader(OriginConfig{Headers: map[string]string{"x-api-key": "key"}, Username: "user", Password: "pass"})
+	if header.Get("X-Api-Key") != "key" || header.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+		t.Error("origin headers not as expected")
+	}
+
+	// credentials are part of the source cache key
+	if sourceCacheKey(&sourceRequest{url: "http://a/b.jpg"}) == sourceCacheKey(&sourceRequest{url: "http://a/b.jpg", header: header}) {
+		t.Error("sources fetched with origin headers should be kept apart")
+	}
+}
+
+func TestFillThumbnailParamsSource(t *testing.T) {
+	initTestManager(t)
+	config := &CommonServiceConfig{
+		AllowHosts: []string{"*.example.com"},
+		Origins: map[string]OriginConfig{"products": {Url: "https://products.internal/images", Username: "user"}},
+	}
+
+	params, err := fillThumbnailParams(parseQuery(t, "src=products&path=/a/b.jpg&width=100"), config)
+	if err != nil || params.url != "https://products.internal/images/a/b.jpg" || params.origin != "products" ||
+		params.originHeader.Get("Authorization") == "" || params.fileName != "b.jpg" {
+		t.Fatal("named origin should be resolved")
+	}
+
+	if params, err = fillThumbnailParams(parseQuery(t, "url=http://img.example.com/a.jpg&width=100"), config); err != nil || params.hosts == nil {
+		t.Error("allowed host should be accepted")
+	}
+
+	for query, expected := range map[string]string{
+		"url=http://evil.com/a.jpg&width=100": "host evil.com not allowed",
+		"src=unknown&path=/a.jpg&width=100": "src unknown not found",
+		"src=products&width=100": "path not found",
+		"src=products&path=/a.jpg&url=http://img.example.com/a.jpg&width=100": "url and src are exclusive",
+	} {
+		if _, err := fillThumbnailParams(parseQuery(t, query), config); err == nil || err.Error() != expected {
+			t.Error("query " + query + " should fail with " + expected)
+		}
+	}
+
+	for _, invalid := range []CommonServiceConfig{
+		{Path: "/hosts", AllowHosts: []string{"a*.example.com"}},
+		{Path: "/hosts", DenyHosts: []string{""}},
+		{Path: "/hosts", Origins: map[string]OriginConfig{"a": {Url: "ftp://example.com"}}},
+		{Path: "/hosts", Origins: map[string]OriginConfig{"a": {Url: "/images"}}},
+	} {
+		if err := registerThumbnail(&invalid); err == nil {
+			t.Errorf("configuration should not be valid: %+v", invalid)
+		}
+	}
+}
+
+func TestThumbnailHandlerOrigin(t *testing.T) {
+	initTestManager(t)
+
+	var buf bytes.Buffer
+	imaging.Encode(&buf, newTestImage(400, 200), imaging.PNG)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); ok == false || user != "user" || password != "pass" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, strings.Replace(r.Host, "127.0.0.1", "http://localhost", 1) + "/images/image.png", http.StatusFound)
+			return
+		}
+		if r.URL.Path != "/images/image.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	config := &CommonServiceConfig{
+		AllowHosts: []string{"127.0.0.1"},
+		Origins: map[string]OriginConfig{"products": {Url: server.URL + "/images/", Headers: map[string]string{"X-Api-Key": "key"}, Username: "user", Password: "pass"}},
+	}
+
+	w := requestThumbnail("src=products&path=/image.png&width=100", "", config)
+	if img, _, err := image.DecodeConfig(w.Body); err != nil || img.Width != 100 {
+		t.Error("named origin image should be resized")
+	}
+
+	// the client can't reach the origin without its credentials
+	if w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/images/image.png") + "&width=100", "", config); w.Code == http.StatusOK {
+		t.Error("origin image should not be fetched without credentials")
+	}
+
+	// not permitted host, json error
+	w = requestThumbnail("url=" + url.QueryEscape("http://localhost/image.png") + "&width=100", "", config)
+	var res errorResponse
+	if json.Unmarshal(w.Body.Bytes(), &res) != nil || res.Code != "bad_request" || res.Message != "host localhost not allowed" {
+		t.Error("not permitted host should be a json error, got " + w.Body.String())
+	}
+
+	// redirect to a not permitted host
+	r := &sourceRequest{url: server.URL + "/redirect", header: originHeader(config.Origins["products"]), hosts: newHostPolicy(config)}
+	if _, err := downloadSource(r, "", 1000); err == nil || strings.Contains(err.Error(), errFetchHostNotAllowed.Error()) == false {
+		t.Error("redirect to a not permitted host should be refused")
+	}
+}
+
+func TestSourceFetcherLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chunked":
+			// no Content-Length
+			for i := 0; i < 10; i++ {
+				w.Write(bytes.Repeat([]byte("x"), 100))
+				w.(http.Flusher).Flush()
+			}
+		case "/slow":
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("late"))
+		case "/drip":
+			for i := 0; i < 10; i++ {
+				w.Write([]byte("x"))
+				w.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		case "/redirect2":
+			http.Redirect(w, r, "/redirect1", http.StatusFound)
+		case "/redirect1":
+			http.Redirect(w, r, "/", http.StatusFound)
+		default:
+			w.Write(bytes.Repeat([]byte("x"), 1000))
+		}
+	}))
+	defer server.Close()
+
+	allow := []string{"127.0.0.1"}
+	read := func(fetcher *sourceFetcher, rawUrl string) error {
+		resp, err := fetcher.Get(rawUrl)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+
+	// maximum size, declared and streamed
+	fetcher, _ := newSourceFetcher(FetchConfig{AllowNetworks: allow, MaxSize: 999})
+	if err := read(fetcher, server.URL); err != errSourceTooLarge {
+		t.Error("declared size above the maximum should be refused")
+	}
+	if err := read(fetcher, server.URL + "/chunked"); err != errSourceTooLarge {
+		t.Error("streamed size above the maximum should be refused")
+	}
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: allow, MaxSize: 1000})
+	if err := read(fetcher, server.URL + "/chunked"); err != nil {
+		t.Error("size at the maximum should be read")
+	}
+
+	// timeouts
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: allow, ReadTimeout: 100})
+	if err := read(fetcher, server.URL + "/slow"); err == nil {
+		t.Error("read timeout should stop the download")
+	}
+	if err := read(fetcher, server.URL + "/drip"); err != nil {
+		t.Error("read timeout should apply to each read")
+	}
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: allow, Timeout: 200})
+	if err := read(fetcher, server.URL + "/drip"); err == nil {
+		t.Error("timeout should stop the whole download")
+	}
+
+	// redirects
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: allow, MaxRedirects: 1})
+	if err := read(fetcher, server.URL + "/redirect1"); err != nil {
+		t.Error("redirects up to the maximum should be followed")
+	}
+	if err := read(fetcher, server.URL + "/redirect2"); err == nil || strings.Contains(err.Error(), errFetchRedirects.Error()) == false {
+		t.Error("redirects above the maximum should be refused")
+	}
+	fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: allow, MaxRedirects: -1})
+	if err := read(fetcher, server.URL + "/redirect1"); err == nil {
+		t.Error("redirects should be refused")
+	}
+
+	for _, config := range []FetchConfig{{ConnectTimeout: -1}, {ReadTimeout: -1}, {Timeout: -1}, {MaxSize: -1}, {MaxRedirects: -2}} {
+		if _, err := newSourceFetcher(config); err == nil {
+			t.Errorf("fetch limits should not be valid: %+v", config)
+		}
+	}
+}
+
+func TestSourceFetcherCheckResponse(t *testing.T) {
+	fetcher, _ := newSourceFetcher(FetchConfig{CheckContentType: true})
+
+	tests := []struct {
+		status int
+		contentType string
+		valid bool
+	}{
+		{200, "image/jpeg", true},
+		{200, "image/png; charset=binary", true},
+		{200, "application/octet-stream", true},
+		{200, "", true},
+		{200, "text/html; charset=utf-8", false},
+		{204, "image/png", true},
+		{301, "image/png", false},
+		{404, "text/html", false},
+		{500, "image/png", false},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Header: http.Header{"Content-Type": {test.contentType}}}
+		if err := fetcher.checkResponse(resp); (err == nil) != test.valid {
+			t.Errorf("response %d %s valid should be %v", test.status, test.contentType, test.valid)
+		}
+	}
+
+	fetcher, _ = newSourceFetcher(FetchConfig{})
+	if fetcher.checkResponse(&http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/html"}}}) != nil {
+		t.Error("content type should not be checked by default")
+	}
+}
+
+func TestThumbnailHandlerDownloadLimits(t *testing.T) {
+	initTestManager(t)
+
+	var buf bytes.Buffer
+	imaging.Encode(&buf, newTestImage(400, 200), imaging.PNG)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<html>Not found</html>"))
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	// the error page is not decoded
+	w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/missing.png") + "&width=100", "", &CommonServiceConfig{})
+	if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "404") == false {
+		t.Error("upstream error status should be reported, got " + w.Body.String())
+	}
+
+	fetcher := gServiceManager.fetcher
+	gServiceManager.fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.1"}, MaxSize: int64(buf.Len() - 1)})
+	defer func() { gServiceManager.fetcher = fetcher }()
+
+	if w := requestThumbnail("url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100", "", &CommonServiceConfig{}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("source above the maximum size should be 413, got %d", w.Code)
+	}
+}
+
+func TestFetchError(t *testing.T) {
+	tests := []struct {
+		err error
+		status int
+	}{
+		{errSourceTooLarge, http.StatusRequestEntityTooLarge},
+		{&url.Error{Op: "Get", URL: "http://127.0.0.1", Err: &net.OpError{Op: "dial", Err: errFetchBlocked}}, http.StatusBadRequest},
+		{&url.Error{Op: "Get", URL: "file:///etc/passwd", Err: errFetchScheme}, http.StatusBadRequest},
+		{&url.Error{Op: "Get", URL: "http://other.example.com", Err: errFetchHostNotAllowed}, http.StatusBadRequest},
+		{&url.Error{Op: "Get", URL: "http://127.0.0.1", Err: errors.New("connection refused")}, http.StatusBadGateway},
+		{&url.Error{Op: "Get", URL: "http://127.0.0.1", Err: &net.DNSError{Err: "timeout", IsTimeout: true}}, http.StatusGatewayTimeout},
+		{newServiceError(errorUpstreamNotFound, errors.New("Source response status 404")), http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		if status := errorStatus(fetchError(test.err)); status != test.status {
+			t.Errorf("%v status should be %d, got %d", test.err, test.status, status)
+		}
+	}
+
+	if errorStatus(errors.New("Image Encode Error")) != http.StatusInternalServerError {
+		t.Error("error without kind should be internal")
+	}
+	if newServiceError(errorBadRequest, nil) != nil || fetchError(nil) != nil {
+		t.Error("nil error should stay nil")
+	}
+}
+
+func TestThumbnailHandlerErrorStatus(t *testing.T) {
+	initTestManager(t)
+
+	var buf bytes.Buffer
+	imaging.Encode(&buf, newTestImage(400, 200), imaging.PNG)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.png":
+			http.NotFound(w, r)
+		case "/failing.png":
+			http.Error(w, "failure", http.StatusInternalServerError)
+		case "/slow.png":
+			time.Sleep(300 * time.Millisecond)
+			w.Write(buf.Bytes())
+		case "/page.html":
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		case "/corrupt.png":
+			w.Write(buf.Bytes()[:buf.Len() / 2])
+		default:
+			w.Write(buf.Bytes())
+		}
+	}))
+	defer server.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	fetcher := gServiceManager.fetcher
+	gServiceManager.fetcher, _ = newSourceFetcher(FetchConfig{AllowNetworks: []string{"127.0.0.1"}, Timeout: 100, MaxSize: int64(buf.Len())})
+	defer func() { gServiceManager.fetcher = fetcher }()
+
+	tests := []struct {
+		name string
+		query string
+		config *CommonServiceConfig
+		status int
+	}{
+		{"ok", "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100", &CommonServiceConfig{}, http.StatusOK},
+		{"bad parameter", "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=abc", &CommonServiceConfig{}, http.StatusBadRequest},
+		{"no url", "width=100", &CommonServiceConfig{}, http.StatusBadRequest},
+		{"upstream not found", "url=" + url.QueryEscape(server.URL + "/missing.png") + "&width=100", &CommonServiceConfig{}, http.StatusNotFound},
+		{"upstream failure", "url=" + url.QueryEscape(server.URL + "/failing.png") + "&width=100", &CommonServiceConfig{}, http.StatusBadGateway},
+		{"upstream unreachable", "url=" + url.QueryEscape(closed.URL + "/image.png") + "&width=100", &CommonServiceConfig{}, http.StatusBadGateway},
+		{"upstream timeout", "url=" + url.QueryEscape(server.URL + "/slow.png") + "&width=100", &CommonServiceConfig{}, http.StatusGatewayTimeout},
+		{"unsupported format", "url=" + url.QueryEscape(server.URL + "/page.html") + "&width=100", &CommonServiceConfig{}, http.StatusUnsupportedMediaType},
+		{"format not allowed", "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100", &CommonServiceConfig{SourceFormats: []string{"jpeg"}}, http.StatusUnsupportedMediaType},
+		{"image too large", "url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100", &CommonServiceConfig{MaxSourcePixels: 100}, http.StatusRequestEntityTooLarge},
+		{"corrupt image", "url=" + url.QueryEscape(server.URL + "/corrupt.png") + "&width=100", &CommonServiceConfig{}, http.StatusUnprocessableEntity},
+	}
+
+	for _, test := range tests {
+		w := requestThumbnail(test.query, "", test.config)
+		if w.Code != test.status {
+			t.Errorf("%s: status should be %d, got %d %s", test.name, test.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err error
+		status int
+		code string
+	}{
+		{errors.New("Image Encode Error"), http.StatusInternalServerError, "internal_error"},
+		{newServiceError(errorBadRequest, errors.New("width \"abc\" Not valid")), http.StatusBadRequest, "bad_request"},
+		{newServiceError(errorUpstreamNotFound, errors.New("not found")), http.StatusNotFound, "upstream_not_found"},
+		{newServiceError(errorUpstream, errors.New("failed")), http.StatusBadGateway, "upstream_error"},
+		{newServiceError(errorUpstreamTimeout, errors.New("timeout")), http.StatusGatewayTimeout, "upstream_timeout"},
+		{newServiceError(errorUnsupportedFormat, errors.New("format")), http.StatusUnsupportedMediaType, "unsupported_format"},
+		{newServiceError(errorTooLarge, errors.New("large")), http.StatusRequestEntityTooLarge, "too_large"},
+		{newServiceError(errorUnprocessable, errors.New("corrupt")), http.StatusUnprocessableEntity, "unprocessable_image"},
+		{newServiceError(errorBusy, errors.New("busy")), http.StatusServiceUnavailable, "busy"},
+		{newServiceError(errorUnauthorized, errors.New("token")), http.StatusUnauthorized, "unauthorized"},
+		{newServiceError(errorMethodNotAllowed, errors.New("method")), http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		writeError(w, httptest.NewRequest("GET", "/thumbnail", nil), test.err)
+
+		var res errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Errorf("%s: response should be json, got %s", test.code, w.Body.String())
+			continue
+		}
+		if w.Code != test.status || res.Code != test.code || res.Message != test.err.Error() {
+			t.Errorf("%s: got %d %+v", test.code, w.Code, res)
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Error("content type should be json, got " + w.Header().Get("Content-Type"))
+		}
+		if res.RequestId == "" || res.RequestId != w.Header().Get("X-Request-Id") {
+			t.Error("request id should be generated and sent in the header")
+		}
+		if res.Details != nil {
+			t.Error("details should be omitted")
+		}
+	}
+
+	// every kind has a code and a status
+	for kind := errorInternal; kind <= errorMethodNotAllowed; kind++ {
+		if errorKindCode[kind] == "" || errorKindStatus[kind] == 0 {
+			t.Errorf("error kind %d should have a code and a status", kind)
+		}
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	tests := []struct {
+		id string
+		kept bool
+	}{
+		{"abc-123", true},
+		{"4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"trace:1.2_3", true},
+		{"", false},
+		{"id with spaces", false},
+		{"id\"quote", false},
+		{strings.Repeat("a", requestIdMaxLength + 1), false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/thumbnail", nil)
+		r.Header.Set("X-Request-Id", test.id)
+		w := httptest.NewRecorder()
+		if id := requestId(w, r); (id == test.id) != test.kept || isRequestIdValid(id) == false {
+			t.Errorf("request id %q kept should be %v, got %q", test.id, test.kept, id)
+		}
+	}
+
+	if newRequestId() == newRequestId() {
+		t.Error("generated request ids should be unique")
+	}
+}
+
+func TestThumbnailHandlerErrorResponse(t *testing.T) {
+	initTestManager(t)
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	r := httptest.NewRequest("GET", "/thumbnail?url=" + url.QueryEscape(server.URL + "/image.png") + "&width=100", nil)
+	r.Header.Set("X-Request-Id", "request-1")
+	w := httptest.NewRecorder()
+	thumbnailHandler(w, r, &CommonServiceConfig{})
+
+	var res errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusNotFound {
+		t.Fatal("upstream error should be a json 404, got " + w.Body.String())
+	}
+	if res.Code != "upstream_not_found" || res.RequestId != "request-1" || res.Details["upstream_status"] != float64(404) {
+		t.Errorf("upstream error response not valid: %+v", res)
+	}
+
+	// messages are escaped
+	w = requestThumbnail("url=" + url.QueryEscape(server.URL + "/image.png") + "&width=%22quoted%22", "", &CommonServiceConfig{})
+	if json.Unmarshal(w.Body.Bytes(), &res) != nil || res.Code != "bad_request" || w.Header().Get("Content-Type") != "application/json" {
+		t.Error("parameter error should be a json 400, got " + w.Body.String())
+	}
+
+	// busy, retry after in the details
+	pool := gServiceManager.pool
+	gServiceManager.pool = newWorkerPool(1, 0, time.Millisecond)
+	defer func() { gServiceManager.pool = pool }()
+	gServiceManager.pool.Acquire()
+	defer gServiceManager.pool.Release()
+
+	source := newTestImageServer(newTestImage(40, 20), imaging.PNG)
+	defer source.Close()
+
+	w = requestThumbnail("url=" + url.QueryEscape(source.URL + "/image.png") + "&width=10", "", &CommonServiceConfig{})
+	if json.Unmarshal(w.Body.Bytes(), &res) != nil || res.Code != "busy" || res.Details["retry_after"] == nil || w.Header().Get("Retry-After") == "" {
+		t.Error("busy error should report retry after, got " + w.Body.String())
+	}
+}
+
+func TestThumbnailHandlerOriginRedirect(t *testing.T) {
+	initTestManager(t)
+
+	var leaked int32
+	other := newTestListenerServer(t, "127.0.0.2:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "" || r.Header.Get("Authorization") != "" {
+			atomic.AddInt32(&leaked, 1)
+		}
+		imaging.Encode(w, newTestImage(40, 20), imaging.PNG)
+	}))
+	defer other.Close()
+
+	origin := newTestListenerServer(t, "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/local.png" {
+			http.Redirect(w, r, "/images/image.png", http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/images/image.png" {
+			imaging.Encode(w, newTestImage(40, 20), imaging.PNG)
+			return
+		}
+		http.Redirect(w, r, other.URL + "/image.png", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	config := &CommonServiceConfig{
+		AllowHosts: []string{"*"},
+		Origins: map[string]OriginConfig{"products": {Url: origin.URL + "/images/", Headers: map[string]string{"X-Api-Key": "secret"}, Username: "user", Password: "pass"}},
+	}
+
+	if w := requestThumbnail("src=products&path=/remote.png&width=10", "", config); w.Code != http.StatusBadRequest {
+		t.Errorf("origin redirect to another host should be refused with 400, got %d", w.Code)
+	}
+	if leaked != 0 {
+		t.Error("origin headers should never reach another host")
+	}
+
+	if w := requestThumbnail("src=products&path=/local.png&width=10", "", config); w.Code != http.StatusOK {
+		t.Error("origin redirect on the origin host should be followed")
+	}
+
+	// service denied hosts apply to origins
+	config.DenyHosts = []string{"127.0.0.1"}
+	if w := requestThumbnail("src=products&path=/image.png&width=10", "", config); w.Code != http.StatusBadRequest {
+		t.Error("denied origin host should be refused")
+	}
+}
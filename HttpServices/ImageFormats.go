@@ -0,0 +1,207 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// source and output image formats, content negotiation
+
+import (
+	"image"
+	"mime"
+	"strconv"
+	"strings"
+	"github.com/disintegration/imaging"
+	_ "image/gif" // register source decoders
+	_ "image/png"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// supported source formats, names as detected by image.DecodeConfig
+var sourceFormats = []string{"jpeg", "png", "gif", "bmp", "tiff", "webp"}
+
+// is source format supported
+func isSourceFormatValid(format string) bool {
+	for _, f := range sourceFormats {
+		if format == f {
+			return true
+		}
+	}
+	return false
+}
+
+// is source format in the allowed list, empty list allows all supported formats
+func isSourceFormatAllowed(format string, allowed []string) bool {
+	if isSourceFormatValid(format) == false {
+		return false
+	}
+
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, f := range allowed {
+		if normalizeFormat(f) == format {
+			return true
+		}
+	}
+	return false
+}
+
+// output image format
+type imageFormat struct {
+	encoder imaging.Format // imaging encoder of the format
+	extension string // file extension
+	contentType string // mime type
+}
+
+// supported output formats, by format parameter value
+var outputFormats = map[string]*imageFormat{
+	"jpeg": {imaging.JPEG, "jpg", "image/jpeg"},
+	"png": {imaging.PNG, "png", "image/png"},
+	"gif": {imaging.GIF, "gif", "image/gif"},
+}
+
+// known output formats without a pure go encoder
+var unavailableOutputFormats = []string{"webp"}
+
+// output format values which are not a format name
+const (
+	formatAuto = "auto" // negotiate by the Accept header and the image alpha
+	formatSource = "" // same format as the source image
+)
+
+// normalize format parameter value, jpg is jpeg
+func normalizeFormat(format string) string {
+	format = strings.ToLower(format)
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// is output format value valid/supported
+func isOutputFormatValid(format string) bool {
+	if format == formatAuto || format == formatSource {
+		return true
+	}
+	_, ok := outputFormats[format]
+	return ok
+}
+
+// is output format known, but no encoder available
+func isOutputFormatUnavailable(format string) bool {
+	for _, f := range unavailableOutputFormats {
+		if format == f {
+			return true
+		}
+	}
+	return false
+}
+
+// pick output format for auto, by the formats the client accepts and the image alpha
+func negotiateFormat(accept string, img image.Image) string {
+	preferred := []string{"jpeg", "png", "gif"}
+	if isOpaque(img) == false {
+		preferred = []string{"png", "gif", "jpeg"} // keep transparency
+	}
+
+	for _, format := range preferred {
+		if isContentTypeAccepted(accept, outputFormats[format].contentType) {
+			return format
+		}
+	}
+
+	return "jpeg" // client accepts none, most compatible
+}
+
+// is content type accepted by Accept header value (empty header accepts all)
+func isContentTypeAccepted(accept string, contentType string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+
+	mainType := strings.Split(contentType, "/")[0] + "/*"
+	accepted := false
+	bestMatch := 0 // more specific match wins: 1 for */*, 2 for type/*, 3 for exact
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		match := 0
+		switch mediaType {
+		case contentType:
+			match = 3
+		case mainType:
+			match = 2
+		case "*/*":
+			match = 1
+		}
+
+		if match <= bestMatch {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				q = 0
+			}
+		}
+
+		bestMatch = match
+		accepted = q > 0
+	}
+
+	return accepted
+}
+
+// does the image have no transparent pixels
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// output format for a source image format, formats without encoder are negotiated by the image alpha
+func outputFormatFor(sourceFormat string, img image.Image) string {
+	if _, ok := outputFormats[sourceFormat]; ok {
+		return sourceFormat
+	}
+	return negotiateFormat("", img)
+}
+
+// replace file name extension by the output format extension
+func fileNameWithFormat(fileName string, format string) string {
+	if i := strings.LastIndex(fileName, "."); i >= 0 {
+		fileName = fileName[:i]
+	}
+	return fileName + "." + outputFormats[format].extension
+}
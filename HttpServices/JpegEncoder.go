@@ -0,0 +1,528 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// jpeg encoder with progressive and chroma subsampling controls.
+// the standard library encoder writes baseline 4:2:0 only, it is still used for that case.
+// progressive images use spectral selection scans (no successive approximation)
+// with the standard huffman tables of the jpeg specification, annex k.
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// jpeg encoding options
+type jpegOptions struct {
+	quality int // 1..100
+	progressive bool // progressive scans instead of a single baseline scan
+	subsampling string // chroma subsampling
+}
+
+// supported chroma subsampling
+const (
+	chromaSubsampling420 = "420" // chroma at half width and half height
+	chromaSubsampling444 = "444" // chroma at full resolution
+)
+
+// progressive scans, after the dc scan of all components: component index, first and last coefficient
+var jpegProgressiveScans = [][3]int{{0, 1, 5}, {1, 1, 63}, {2, 1, 63}, {0, 6, 63}}
+
+// zigzag index to natural (row major) index
+var jpegUnzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// standard quantization tables (luminance, chrominance) in zigzag order
+var jpegUnscaledQuant = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffman table definition: number of codes of each length (1..16 bits), and the coded values
+type jpegHuffmanSpec struct {
+	counts [16]int
+	values []byte
+}
+
+// huffman table indexes
+const (
+	jpegHuffLuminanceDC = iota
+	jpegHuffLuminanceAC
+	jpegHuffChrominanceDC
+	jpegHuffChrominanceAC
+)
+
+// standard huffman tables
+var jpegHuffmanSpecs = [4]jpegHuffmanSpec{
+	{
+		[16]int{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]int{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]int{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]int{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// dct cosine table, jpegDctCos[x][u] = cos((2x+1)u*pi/16) * c(u)/2
+var jpegDctCos [8][8]float64
+
+func init() {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c := 0.5
+			if u == 0 {
+				c = 0.5 / math.Sqrt2
+			}
+			jpegDctCos[x][u] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+}
+
+// single color component of the encoded image
+type jpegComponent struct {
+	id byte // component id
+	h, v int // sampling factors
+	table int // quantization and huffman table, 0 luminance 1 chrominance
+	width, height int // size in samples
+	samples []float64 // component samples, row major
+	blocksX, blocksY int // blocks in the mcu padded grid
+	blocks [][64]int32 // quantized coefficients in zigzag order, row major on the padded grid
+	pred int32 // dc predictor of the current scan
+}
+
+// jpeg encoder state
+type jpegEncoder struct {
+	w *bufio.Writer
+	err error // first write error
+	bits uint32 // pending bits, msb aligned
+	nBits uint32 // number of pending bits
+	quant [2][64]int32 // scaled quantization tables in zigzag order
+	huff [4][]uint32 // huffman lookup: code size in the 8 high bits, code in the 24 low bits
+	width, height int // image size
+	mcusX, mcusY int // number of mcus
+	components []*jpegComponent
+}
+
+// encode image as jpeg
+func encodeJpeg(w io.Writer, img image.Image, opts jpegOptions) error {
+	if opts.progressive == false && opts.subsampling != chromaSubsampling444 {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.quality})
+	}
+
+	e := newJpegEncoder(w, img, opts)
+	e.writeHeaders(opts.progressive)
+
+	if opts.progressive {
+		e.writeScan(e.components, 0, 0)
+		for _, scan := range jpegProgressiveScans {
+			e.writeScan(e.components[scan[0]:scan[0]+1], scan[1], scan[2])
+		}
+	} else {
+		e.writeScan(e.components, 0, 63)
+	}
+
+	e.writeMarker(0xd9, nil) // end of image
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// create encoder, convert the image to quantized dct blocks
+func newJpegEncoder(w io.Writer, img image.Image, opts jpegOptions) *jpegEncoder {
+	e := &jpegEncoder{w: bufio.NewWriter(w)}
+
+	// quantization tables, scaled like libjpeg
+	quality := clampInt(opts.quality, 1, 100)
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i := range e.quant {
+		for k := range e.quant[i] {
+			e.quant[i][k] = int32(clampInt((jpegUnscaledQuant[i][k]*scale+50)/100, 1, 255))
+		}
+	}
+
+	for i, spec := range jpegHuffmanSpecs {
+		e.huff[i] = jpegHuffmanLUT(spec)
+	}
+
+	// color conversion
+	b := img.Bounds()
+	e.width, e.height = b.Dx(), b.Dy()
+	planes := [3][]float64{}
+	for i := range planes {
+		planes[i] = make([]float64, e.width*e.height)
+	}
+	for y := 0; y < e.height; y++ {
+		for x := 0; x < e.width; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA() // alpha premultiplied, composed on black
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			planes[0][y*e.width+x] = float64(yy)
+			planes[1][y*e.width+x] = float64(cb)
+			planes[2][y*e.width+x] = float64(cr)
+		}
+	}
+
+	// components, luminance sampling factors define the mcu size
+	lumaFactor := 1
+	if opts.subsampling != chromaSubsampling444 {
+		lumaFactor = 2
+	}
+	e.mcusX = (e.width + 8*lumaFactor - 1) / (8 * lumaFactor)
+	e.mcusY = (e.height + 8*lumaFactor - 1) / (8 * lumaFactor)
+
+	for i, plane := range planes {
+		c := &jpegComponent{id: byte(i + 1), h: 1, v: 1, table: 1, width: e.width, height: e.height, samples: plane}
+		if i == 0 {
+			c.h, c.v, c.table = lumaFactor, lumaFactor, 0
+		} else if lumaFactor > 1 {
+			c.downsample(lumaFactor)
+		}
+		c.blocksX, c.blocksY = e.mcusX*c.h, e.mcusY*c.v
+		c.transform(&e.quant[c.table])
+		e.components = append(e.components, c)
+	}
+
+	return e
+}
+
+// downsample component samples by averaging factor x factor samples
+func (c *jpegComponent) downsample(factor int) {
+	width := (c.width + factor - 1) / factor
+	height := (c.height + factor - 1) / factor
+	samples := make([]float64, width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sum := 0.0
+			for dy := 0; dy < factor; dy++ {
+				for dx := 0; dx < factor; dx++ {
+					sum += c.sample(x*factor+dx, y*factor+dy)
+				}
+			}
+			samples[y*width+x] = sum / float64(factor*factor)
+		}
+	}
+
+	c.width, c.height, c.samples = width, height, samples
+}
+
+// sample value, the edge is replicated outside the component
+func (c *jpegComponent) sample(x int, y int) float64 {
+	return c.samples[clampInt(y, 0, c.height-1)*c.width+clampInt(x, 0, c.width-1)]
+}
+
+// forward dct and quantization of all the blocks of the padded grid
+func (c *jpegComponent) transform(quant *[64]int32) {
+	c.blocks = make([][64]int32, c.blocksX*c.blocksY)
+
+	var tmp [64]float64
+	for by := 0; by < c.blocksY; by++ {
+		for bx := 0; bx < c.blocksX; bx++ {
+			// rows
+			for y := 0; y < 8; y++ {
+				var row [8]float64
+				for x := 0; x < 8; x++ {
+					row[x] = c.sample(bx*8+x, by*8+y) - 128
+				}
+				for u := 0; u < 8; u++ {
+					sum := 0.0
+					for x := 0; x < 8; x++ {
+						sum += row[x] * jpegDctCos[x][u]
+					}
+					tmp[y*8+u] = sum
+				}
+			}
+
+			// columns, and quantization
+			block := &c.blocks[by*c.blocksX+bx]
+			for k := 0; k < 64; k++ {
+				n := jpegUnzig[k]
+				u, v := n%8, n/8
+				sum := 0.0
+				for y := 0; y < 8; y++ {
+					sum += tmp[y*8+u] * jpegDctCos[y][v]
+				}
+				block[k] = int32(math.Floor(sum/float64(quant[k]) + 0.5))
+			}
+		}
+	}
+}
+
+// build huffman lookup table from the table definition
+func jpegHuffmanLUT(spec jpegHuffmanSpec) []uint32 {
+	lut := make([]uint32, 256)
+	code, k := uint32(0), 0
+	for i, count := range spec.counts {
+		for j := 0; j < count; j++ {
+			lut[spec.values[k]] = uint32(i+1)<<24 | code
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return lut
+}
+
+// write bytes, keep the first error
+func (e *jpegEncoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+// write marker with its segment data
+func (e *jpegEncoder) writeMarker(marker byte, data []byte) {
+	e.write([]byte{0xff, marker})
+	if data != nil {
+		length := len(data) + 2
+		e.write([]byte{byte(length >> 8), byte(length)})
+		e.write(data)
+	}
+}
+
+// write start of image, quantization, frame and huffman headers
+func (e *jpegEncoder) writeHeaders(progressive bool) {
+	e.writeMarker(0xd8, nil)
+
+	// quantization tables
+	dqt := []byte{}
+	for i := range e.quant {
+		dqt = append(dqt, byte(i))
+		for _, q := range e.quant[i] {
+			dqt = append(dqt, byte(q))
+		}
+	}
+	e.writeMarker(0xdb, dqt)
+
+	// frame header, baseline or progressive
+	sof := []byte{8, byte(e.height >> 8), byte(e.height), byte(e.width >> 8), byte(e.width), byte(len(e.components))}
+	for _, c := range e.components {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), byte(c.table))
+	}
+	if progressive {
+		e.writeMarker(0xc2, sof)
+	} else {
+		e.writeMarker(0xc0, sof)
+	}
+
+	// huffman tables, class (0 dc, 1 ac) and id (0 luminance, 1 chrominance)
+	dht := []byte{}
+	for i, spec := range jpegHuffmanSpecs {
+		dht = append(dht, byte((i%2)<<4|i/2))
+		for _, count := range spec.counts {
+			dht = append(dht, byte(count))
+		}
+		dht = append(dht, spec.values...)
+	}
+	e.writeMarker(0xc4, dht)
+}
+
+// write a scan of the coefficients [ss, se] of the components.
+// several components are interleaved in mcu order, a single component is written in its own block order
+func (e *jpegEncoder) writeScan(components []*jpegComponent, ss int, se int) {
+	sos := []byte{byte(len(components))}
+	for _, c := range components {
+		sos = append(sos, c.id, byte(c.table<<4|c.table))
+	}
+	sos = append(sos, byte(ss), byte(se), 0)
+	e.writeMarker(0xda, sos)
+
+	for _, c := range components {
+		c.pred = 0
+	}
+
+	if len(components) > 1 {
+		for my := 0; my < e.mcusY; my++ {
+			for mx := 0; mx < e.mcusX; mx++ {
+				for _, c := range components {
+					for v := 0; v < c.v; v++ {
+						for h := 0; h < c.h; h++ {
+							e.writeBlock(c, &c.blocks[(my*c.v+v)*c.blocksX+mx*c.h+h], ss, se)
+						}
+					}
+				}
+			}
+		}
+	} else {
+		c := components[0]
+		for by := 0; by < (c.height+7)/8; by++ {
+			for bx := 0; bx < (c.width+7)/8; bx++ {
+				e.writeBlock(c, &c.blocks[by*c.blocksX+bx], ss, se)
+			}
+		}
+	}
+
+	e.emit(0x7f, 7) // pad the last byte with ones
+	e.bits, e.nBits = 0, 0
+}
+
+// write coefficients [ss, se] of a block
+func (e *jpegEncoder) writeBlock(c *jpegComponent, block *[64]int32, ss int, se int) {
+	dcTable, acTable := c.table*2, c.table*2+1
+
+	if ss == 0 {
+		e.emitHuffValue(dcTable, 0, block[0]-c.pred)
+		c.pred = block[0]
+		ss = 1
+	}
+
+	run := 0
+	for k := ss; k <= se; k++ {
+		if block[k] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			e.emitHuff(acTable, 0xf0) // sixteen zeros
+			run -= 16
+		}
+		e.emitHuffValue(acTable, run, block[k])
+		run = 0
+	}
+
+	if run > 0 {
+		e.emitHuff(acTable, 0x00) // end of block
+	}
+}
+
+// emit bits, msb first, with 0xff byte stuffing
+func (e *jpegEncoder) emit(bits uint32, nBits uint32) {
+	nBits += e.nBits
+	bits <<= 32 - nBits
+	bits |= e.bits
+	for nBits >= 8 {
+		b := byte(bits >> 24)
+		e.write([]byte{b})
+		if b == 0xff {
+			e.write([]byte{0})
+		}
+		bits <<= 8
+		nBits -= 8
+	}
+	e.bits, e.nBits = bits, nBits
+}
+
+// emit huffman code of value
+func (e *jpegEncoder) emitHuff(table int, value byte) {
+	code := e.huff[table][value]
+	e.emit(code&(1<<24-1), code>>24)
+}
+
+// emit zero run length and size category code, followed by the value bits
+func (e *jpegEncoder) emitHuffValue(table int, run int, value int32) {
+	a, b := value, value
+	if a < 0 {
+		a, b = -value, value-1 // negative values are written in one's complement
+	}
+
+	size := uint32(0)
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+
+	e.emitHuff(table, byte(run<<4)|byte(size))
+	if size > 0 {
+		e.emit(uint32(b)&(1<<size-1), size)
+	}
+}
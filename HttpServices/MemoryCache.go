@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// in process memory cache of rendered thumbnails, in front of the disk cache.
+// bounded by a byte budget, least recently used entries are evicted first.
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// memory cache item
+type memoryCacheItem struct {
+	key string
+	entry *cacheEntry
+	size int64
+}
+
+// memory cache counters
+type memoryCacheStats struct {
+	Entries int `json:"entries"`
+	Size int64 `json:"size"`
+	MaxSize int64 `json:"maxsize"`
+	Hits uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// memory cache, safe for concurrent use
+type memoryCache struct {
+	maxSize int64 // byte budget
+	mutex sync.Mutex // guard
+	size int64 // size of the cached entries
+	lru *list.List // items, most recently used first
+	items map[string]*list.Element // items by key
+	hits uint64
+	misses uint64
+	evictions uint64
+}
+
+// create memory cache of maxSize bytes
+func newMemoryCache(maxSize int64) *memoryCache {
+	return &memoryCache{maxSize: maxSize, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// approximate memory size of entry
+func memoryCacheSize(key string, entry *cacheEntry) int64 {
+	size := len(key) + len(entry.data)
+	for name, values := range entry.header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
+
+// get entry of key, nil when not cached
+func (p *memoryCache) Get(key string) *cacheEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	element, ok := p.items[key]
+	if ok == false {
+		p.misses++
+		return nil
+	}
+
+	p.hits++
+	p.lru.MoveToFront(element)
+	return element.Value.(*memoryCacheItem).entry
+}
+
+// put entry of key, entries bigger than the budget are not cached
+func (p *memoryCache) Put(key string, entry *cacheEntry) {
+	size := memoryCacheSize(key, entry)
+	if size > p.maxSize {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if element, ok := p.items[key]; ok {
+		p.removeElement(element)
+	}
+
+	p.items[key] = p.lru.PushFront(&memoryCacheItem{key: key, entry: entry, size: size})
+	p.size += size
+
+	for p.size > p.maxSize {
+		p.removeElement(p.lru.Back())
+		p.evictions++
+	}
+}
+
+// remove entries which key starts with prefix, returns the number of removed entries
+func (p *memoryCache) Purge(prefix string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	count := 0
+	for key, element := range p.items {
+		if strings.HasPrefix(key, prefix) {
+			p.removeElement(element)
+			count++
+		}
+	}
+	return count
+}
+
+// current counters
+func (p *memoryCache) Stats() memoryCacheStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return memoryCacheStats{Entries: len(p.items), Size: p.size, MaxSize: p.maxSize, Hits: p.hits, Misses: p.misses, Evictions: p.evictions}
+}
+
+// remove item. mutex must be locked
+func (p *memoryCache) removeElement(element *list.Element) {
+	item := element.Value.(*memoryCacheItem)
+	p.lru.Remove(element)
+	delete(p.items, item.key)
+	p.size -= item.size
+}
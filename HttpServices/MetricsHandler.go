@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// implements metrics service handler: GET returns the service counters as json
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// metrics service response
+type metricsResponse struct {
+	Pool *workerPoolStats `json:"pool"` // null when unlimited
+	Pixels *pixelBudgetStats `json:"pixels"` // null when unlimited
+}
+
+// registration function
+func registerMetrics(config *CommonServiceConfig) error {
+	if err := validateAdminConfig(config); err != nil {
+		return err
+	}
+
+	http.HandleFunc(config.Path, func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler(w, r, config)
+	})
+	return nil
+}
+
+// metrics service handler
+func metricsHandler(w http.ResponseWriter, r *http.Request, config *CommonServiceConfig) {
+	if isAdminAuthorized(w, r, config) == false {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeError(w, r, newServiceError(errorMethodNotAllowed, errors.New("method Not allowed")))
+		return
+	}
+
+	metrics := metricsResponse{}
+	if gServiceManager.pool != nil {
+		poolStats := gServiceManager.pool.Stats()
+		metrics.Pool = &poolStats
+	}
+	if gServiceManager.pixels != nil {
+		pixelStats := gServiceManager.pixels.Stats()
+		metrics.Pixels = &pixelStats
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
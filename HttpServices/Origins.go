@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// source origins: permitted source hosts (allow / deny lists) and named origins.
+// a named origin is requested by name and path (src=products&path=/a/b.jpg), its base url,
+// headers and credentials are held in the service configuration. named origin requests are permitted
+// only on the origin host, redirects can't take the origin headers and credentials to another host
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// host refused by the host policy
+var errFetchHostNotAllowed = errors.New("Host not allowed")
+
+// source image request
+type sourceRequest struct {
+	url string
+	header http.Header // headers sent to the origin, nil when none
+	hosts *hostPolicy // permitted hosts, checked again on redirects. nil allows all
+}
+
+// permitted source hosts
+type hostPolicy struct {
+	allow []string // exact or wildcard (*.example.com) hosts, empty allows all
+	deny []string // exact or wildcard hosts, always refused
+	origin string // named origin host, the only permitted host when set
+}
+
+// context key of the host policy of a request
+type hostPolicyKey struct{}
+
+// host policy of the service, nil when all hosts are permitted
+func newHostPolicy(config *CommonServiceConfig) *hostPolicy {
+	if len(config.AllowHosts) == 0 && len(config.DenyHosts) == 0 {
+		return nil
+	}
+	return &hostPolicy{allow: config.AllowHosts, deny: config.DenyHosts}
+}
+
+// host policy of a named origin: the origin host only, unless denied by the service
+func newOriginHostPolicy(config *CommonServiceConfig, origin OriginConfig) (*hostPolicy, error) {
+	u, err := url.Parse(origin.Url)
+	if err != nil {
+		return nil, err
+	}
+	return &hostPolicy{deny: config.DenyHosts, origin: strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))}, nil
+}
+
+// is host permitted: not denied, and allowed when there is an allow list (or the origin host)
+func (p *hostPolicy) isAllowed(host string) bool {
+	if p == nil {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchHosts(p.deny, host) {
+		return false
+	}
+	if p.origin != "" {
+		return host == p.origin
+	}
+	return len(p.allow) == 0 || matchHosts(p.allow, host)
+}
+
+// check url host, errFetchHostNotAllowed when not permitted
+func (p *hostPolicy) check(u *url.URL) error {
+	if p.isAllowed(u.Hostname()) == false {
+		return errFetchHostNotAllowed
+	}
+	return nil
+}
+
+// does host match one of the patterns. *.example.com matches the subdomains of example.com, * matches all
+func matchHosts(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// is host pattern valid: a host name, *.domain or *
+func isHostPatternValid(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	pattern = strings.TrimPrefix(pattern, "*.")
+	return pattern != "" && strings.ContainsAny(pattern, "*/:@ ") == false
+}
+
+// validate named origin configuration
+func validateOrigin(name string, origin OriginConfig) error {
+	u, err := url.Parse(origin.Url)
+	if err != nil || isFetchSchemeAllowed(u.Scheme) == false || u.Host == "" {
+		return errors.New("origin " + name + " url Not valid")
+	}
+	return nil
+}
+
+// url of path in named origin, the path can't leave the origin base path
+func originUrl(origin OriginConfig, requestPath string) (string, error) {
+	u, err := url.Parse(origin.Url)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + path.Clean("/" + requestPath)
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// headers sent to named origin, with basic authentication when configured
+func originHeader(origin OriginConfig) http.Header {
+	header := http.Header{}
+	for name, value := range origin.Headers {
+		header.Set(name, value)
+	}
+
+	if origin.Username != "" || origin.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(origin.Username + ":" + origin.Password))
+		header.Set("Authorization", "Basic " + credentials)
+	}
+	return header
+}
+
+// http request of the source request, the host policy is kept in the request context
+func (p *sourceRequest) newRequest() (*http.Request, error) {
+	req, err := http.NewRequest("GET", p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range p.header {
+		req.Header[name] = values
+	}
+
+	if p.hosts != nil {
+		req = req.WithContext(context.WithValue(req.Context(), hostPolicyKey{}, p.hosts))
+	}
+	return req, nil
+}
+
+// host policy of the request, nil when all hosts are permitted
+func requestHostPolicy(req *http.Request) *hostPolicy {
+	hosts, _ := req.Context().Value(hostPolicyKey{}).(*hostPolicy)
+	return hosts
+}
@@ -25,17 +25,30 @@ import (
 	"github.com/go-yaml/yaml"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"time"
 )
 
 // global pointer to service manager
 var gServiceManager *serviceManager = nil
 
+// default spool threshold, 8MB
+const defaultSpoolThreshold = 8 << 20
+
 // service manager structure / needed data
 type serviceManager struct {
 	sessionId int // unique session id counter
 	mutex sync.Mutex // session id guard
 	config ServiceManagerConfig // configuration
 	servicesRegistration map[string] registerService // registration function map
+	diskCache *diskCache // rendered thumbnails disk cache, nil when disabled
+	memoryCache *memoryCache // rendered thumbnails memory cache, nil when disabled
+	sourceCache *diskCache // downloaded source images cache, nil when disabled
+	flights flightGroup // in-flight thumbnail computations
+	pool *workerPool // decode / resize workers, nil when unlimited
+	pixels *pixelBudget // source pixels decoded at once, nil when unlimited
+	fetcher *sourceFetcher // source images fetcher
 }
 
 // create new manager. only if not exists
@@ -48,6 +61,7 @@ func newManager() error {
 	gServiceManager.sessionId = 0
 	gServiceManager.servicesRegistration = make(map[string] registerService)
 	gServiceManager.config.Services = make(map[string]CommonServiceConfig)
+	gServiceManager.fetcher, _ = newSourceFetcher(FetchConfig{}) // default fetcher, replaced by the configured one
 	return nil
 }
 
@@ -79,6 +93,21 @@ func (p *serviceManager) Init(filePath string) error {
 		return err
 	}
 
+	fetcher, err := newSourceFetcher(p.config.Fetch)
+	if err != nil {
+		log.Println("Fetch configuration error: ", err)
+		return err
+	}
+	p.fetcher = fetcher
+
+	if err := p.initCache(); err != nil {
+		return err
+	}
+
+	if err := p.initPool(); err != nil {
+		return err
+	}
+
 	if err := p.registerServices(); err != nil {
 		return err
 	}
@@ -93,14 +122,188 @@ func (p *serviceManager) Start() error {
 	port := os.Getenv("PORT")
 	
 	if port == "" {
-		log.Fatal("$PORT not set")
-        }
+		log.Print("$PORT not set")
+		return errors.New("$PORT not set")
+	}
 	
 	log.Printf("**** Listen on Port:%s *****\n", port)
 	
 	return http.ListenAndServe(":" + port, nil)
 }
 
+// size above which downloads are spooled to the temporary path
+func (p *serviceManager) spoolThreshold() int64 {
+	if p.config.SpoolThreshold > 0 {
+		return p.config.SpoolThreshold
+	}
+	return defaultSpoolThreshold
+}
+
+// create the configured caches
+func (p *serviceManager) initCache() error {
+	if p.config.Cache.MemorySize < 0 {
+		log.Println("Memory cache size Not valid")
+		return errors.New("Memory cache size Not valid")
+	}
+
+	if p.config.Cache.MemorySize > 0 {
+		p.memoryCache = newMemoryCache(p.config.Cache.MemorySize << 20)
+		log.Printf("Memory cache max size:%dMB", p.config.Cache.MemorySize)
+	}
+
+	// caches own their directory: no sharing with each other or with the temporary files
+	paths := map[string]string{"tmppath": p.config.TempPath}
+	for _, cache := range []struct{ name, path string }{{"cache.path", p.config.Cache.Path}, {"cache.sourcepath", p.config.Cache.SourcePath}} {
+		if cache.path == "" {
+			continue
+		}
+		for name, path := range paths {
+			if path != "" && isSamePath(cache.path, path) {
+				log.Printf("%s Not valid, same directory as %s", cache.name, name)
+				return errors.New(cache.name + " Not valid, same directory as " + name)
+			}
+		}
+		paths[cache.name] = cache.path
+	}
+
+	var err error
+	if p.diskCache, err = p.newDiskCache("Disk", p.config.Cache.Path, p.config.Cache.MaxSize); err != nil {
+		return err
+	}
+
+	if p.sourceCache, err = p.newDiskCache("Source", p.config.Cache.SourcePath, p.config.Cache.SourceMaxSize); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// is a the same directory as b
+func isSamePath(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// create disk cache and start its janitor, nil when no path is configured
+func (p *serviceManager) newDiskCache(name string, path string, maxSize int64) (*diskCache, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	cache, err := newDiskCache(path, maxSize)
+	if err != nil {
+		log.Println(name + " cache error: ", err)
+		return nil, err
+	}
+
+	cache.startJanitor(time.Duration(p.config.Cache.JanitorInterval) * time.Second)
+
+	log.Printf("%s cache:%s max size:%d", name, path, maxSize)
+	return cache, nil
+}
+
+// create the decode / resize worker pool and pixel budget
+func (p *serviceManager) initPool() error {
+	if p.config.Workers < 0 || p.config.QueueSize < 0 || p.config.QueueTimeout < 0 || p.config.PixelBudget < 0 {
+		log.Println("Worker pool configuration Not valid")
+		return errors.New("Worker pool configuration Not valid")
+	}
+
+	workers := p.config.Workers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	queueSize := p.config.QueueSize
+	if queueSize == 0 {
+		queueSize = workers * workerPoolDefaultQueueFactor
+	}
+
+	timeout := time.Duration(p.config.QueueTimeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = workerPoolDefaultTimeout
+	}
+
+	pixels := p.config.PixelBudget
+	if pixels == 0 {
+		pixels = pixelBudgetDefault
+	}
+
+	p.pool = newWorkerPool(workers, queueSize, timeout)
+	p.pixels = newPixelBudget(pixels, timeout)
+
+	log.Printf("Workers:%d queue size:%d queue timeout:%v pixel budget:%d", workers, queueSize, timeout, pixels)
+	return nil
+}
+
+// seconds a client rejected by the worker pool or the pixel budget should wait before retrying
+func (p *serviceManager) retryAfter() int {
+	if p.pool != nil {
+		return retryAfterSeconds(p.pool.timeout)
+	}
+	if p.pixels != nil {
+		return retryAfterSeconds(p.pixels.timeout)
+	}
+	return retryAfterSeconds(workerPoolDefaultTimeout)
+}
+
+// is any cache enabled
+func (p *serviceManager) cacheEnabled() bool {
+	return p.memoryCache != nil || p.diskCache != nil
+}
+
+// cached entry of key, memory first and then disk. nil when not cached
+func (p *serviceManager) cacheGet(key string) *cacheEntry {
+	if p.memoryCache != nil {
+		if entry := p.memoryCache.Get(key); entry != nil {
+			return entry
+		}
+	}
+
+	if p.diskCache != nil {
+		if entry := p.diskCache.Get(key); entry != nil {
+			if p.memoryCache != nil {
+				p.memoryCache.Put(key, entry) // hot entries are kept in memory
+			}
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// cache entry of key in all caches
+func (p *serviceManager) cachePut(key string, entry *cacheEntry) error {
+	if p.memoryCache != nil {
+		p.memoryCache.Put(key, entry)
+	}
+
+	if p.diskCache != nil {
+		return p.diskCache.Put(key, entry)
+	}
+
+	return nil
+}
+
+// remove entries which key starts with prefix from all caches, returns the number of removed entries per cache
+func (p *serviceManager) cachePurge(prefix string) (int, int, int) {
+	memoryCount, diskCount, sourceCount := 0, 0, 0
+	if p.memoryCache != nil {
+		memoryCount = p.memoryCache.Purge(prefix)
+	}
+	if p.diskCache != nil {
+		diskCount = p.diskCache.Purge(prefix)
+	}
+	if p.sourceCache != nil {
+		sourceCount = p.sourceCache.Purge(prefix)
+	}
+	return memoryCount, diskCount, sourceCount
+}
+
 func (p *serviceManager) getSessionId() int {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
@@ -113,6 +316,8 @@ func (p *serviceManager) getSessionId() int {
 // fill all available supported services
 func (p *serviceManager) fillRegistration() {
 	p.servicesRegistration["thumbnail"] = registerThumbnail
+	p.servicesRegistration["cache"] = registerCacheAdmin
+	p.servicesRegistration["metrics"] = registerMetrics
 	// TBD add same lines for each service
 }
 
@@ -121,6 +326,7 @@ func (p *serviceManager) registerServices() error {
 
 	// search if
 	for serviceKey, serviceConfig := range p.config.Services {
+		serviceConfig := serviceConfig // services keep a pointer to their own copy
 		if serviceReg, ok := p.servicesRegistration[serviceKey]; ok {
 			if err := serviceReg(&serviceConfig); err!= nil { // register single service
 				log.Printf("Service:%s Registration Error %s", serviceKey, err.Error())
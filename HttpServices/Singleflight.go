@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// request coalescing: concurrent identical thumbnail requests share one in-flight computation
+
+import (
+	"errors"
+	"sync"
+)
+
+// result of a thumbnail computation
+type thumbnailResult struct {
+	entry *cacheEntry // rendered thumbnail, nil on error
+	err error // typed error, see errorKind
+}
+
+// in-flight computation
+type flightCall struct {
+	wg sync.WaitGroup // done when the result is ready
+	result *thumbnailResult
+	dups int // number of requests waiting for the result
+}
+
+// group of in-flight computations by key, the zero value is ready to use
+type flightGroup struct {
+	mutex sync.Mutex // calls guard
+	calls map[string]*flightCall
+}
+
+// run fn once for all concurrent calls with the same key, every caller receives the same result.
+// shared is true when the result was computed for another caller
+func (p *flightGroup) Do(key string, fn func() *thumbnailResult) (result *thumbnailResult, shared bool) {
+	p.mutex.Lock()
+	if p.calls == nil {
+		p.calls = make(map[string]*flightCall)
+	}
+
+	if call, ok := p.calls[key]; ok {
+		call.dups++
+		p.mutex.Unlock()
+		call.wg.Wait()
+		return call.result, true
+	}
+
+	call := &flightCall{result: &thumbnailResult{err: errors.New("Thumbnail Error")}}
+	call.wg.Add(1)
+	p.calls[key] = call
+	p.mutex.Unlock()
+
+	// waiting callers are released even if fn panics
+	defer func() {
+		p.mutex.Lock()
+		delete(p.calls, key)
+		p.mutex.Unlock()
+		call.wg.Done()
+	}()
+
+	if res := fn(); res != nil {
+		call.result = res
+	}
+	return call.result, false
+}
+
+// number of callers waiting for the in-flight computation of key
+func (p *flightGroup) waiting(key string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if call, ok := p.calls[key]; ok {
+		return call.dups
+	}
+	return 0
+}
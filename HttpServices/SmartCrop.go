@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// content aware crop, picks the most interesting region of the image instead of the center.
+// every pixel gets a score from simple heuristics (edge density, saturation and skin tone),
+// and the crop window with the highest total score is kept.
+
+import (
+	"image"
+	"math"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	smartCropAnalysisSize = 256 // images are downscaled to this size before scoring
+	smartCropEdgeWeight = 4 // weight of the luminance laplacian (0..1020)
+	smartCropSaturationWeight = 1 // weight of the color saturation (0..255)
+	smartCropSkinWeight = 255 // bonus for skin tone pixels
+)
+
+// crop the most interesting region with the requested aspect ratio, and resize it to the requested size
+func smartCrop(srcImg image.Image, width int, height int, filter imaging.ResampleFilter) image.Image {
+	rect := smartCropRect(srcImg, width, height)
+	return imaging.Resize(imaging.Crop(srcImg, rect), width, height, filter)
+}
+
+// find the crop rectangle (source coordinates) with the aspect ratio of width x height
+// that covers the highest score
+func smartCropRect(srcImg image.Image, width int, height int) image.Rectangle {
+	b := srcImg.Bounds()
+
+	// size of the crop window in the source image
+	cropWidth, cropHeight := coverCropSize(b.Dx(), b.Dy(), width, height)
+
+	// score a downscaled copy of the image
+	analysisImg := imaging.Fit(srcImg, smartCropAnalysisSize, smartCropAnalysisSize, imaging.Box)
+	ratio := float64(b.Dx()) / float64(analysisImg.Bounds().Dx())
+	table := smartScoreTable(analysisImg)
+
+	// size of the crop window in the analysis image
+	analysisWidth := analysisImg.Bounds().Dx()
+	analysisHeight := analysisImg.Bounds().Dy()
+	windowWidth := clampInt(int(float64(cropWidth) / ratio + 0.5), 1, analysisWidth)
+	windowHeight := clampInt(int(float64(cropHeight) / ratio + 0.5), 1, analysisHeight)
+
+	// slide the window, on equal score prefer the position closest to the center
+	centerX := float64(analysisWidth - windowWidth) / 2
+	centerY := float64(analysisHeight - windowHeight) / 2
+	bestX, bestY := 0, 0
+	bestScore, bestDistance := int64(-1), 0.0
+
+	for y := 0; y <= analysisHeight - windowHeight; y++ {
+		for x := 0; x <= analysisWidth - windowWidth; x++ {
+			score := table.sum(x, y, x + windowWidth, y + windowHeight)
+			distance := math.Abs(float64(x) - centerX) + math.Abs(float64(y) - centerY)
+			if score > bestScore || (score == bestScore && distance < bestDistance) {
+				bestX, bestY = x, y
+				bestScore, bestDistance = score, distance
+			}
+		}
+	}
+
+	// back to source coordinates
+	x := clampInt(int(float64(bestX) * ratio + 0.5), 0, b.Dx() - cropWidth)
+	y := clampInt(int(float64(bestY) * ratio + 0.5), 0, b.Dy() - cropHeight)
+	return image.Rect(b.Min.X + x, b.Min.Y + y, b.Min.X + x + cropWidth, b.Min.Y + y + cropHeight)
+}
+
+// summed area table of the pixel scores
+type scoreTable struct {
+	width int // width of the table (image width + 1)
+	values []int64 // values[y*width+x] is the score sum of the pixels above and left of (x, y)
+}
+
+// total score of the pixels in [x0, x1) x [y0, y1)
+func (p *scoreTable) sum(x0 int, y0 int, x1 int, y1 int) int64 {
+	return p.values[y1*p.width+x1] - p.values[y0*p.width+x1] - p.values[y1*p.width+x0] + p.values[y0*p.width+x0]
+}
+
+// score every pixel of the image and build the summed area table
+func smartScoreTable(img *image.NRGBA) *scoreTable {
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+
+	// luminance of each pixel, used for edge detection
+	luma := make([]int64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*img.Stride + x*4
+			luma[y*width+x] = (299*int64(img.Pix[i]) + 587*int64(img.Pix[i+1]) + 114*int64(img.Pix[i+2])) / 1000
+		}
+	}
+
+	lumaAt := func(x int, y int) int64 {
+		return luma[clampInt(y, 0, height-1)*width+clampInt(x, 0, width-1)]
+	}
+
+	table := &scoreTable{width: width + 1, values: make([]int64, (width+1)*(height+1))}
+	for y := 0; y < height; y++ {
+		rowSum := int64(0)
+		for x := 0; x < width; x++ {
+			i := y*img.Stride + x*4
+			r, g, b := img.Pix[i], img.Pix[i+1], img.Pix[i+2]
+
+			edge := 4*lumaAt(x, y) - lumaAt(x-1, y) - lumaAt(x+1, y) - lumaAt(x, y-1) - lumaAt(x, y+1)
+			if edge < 0 {
+				edge = -edge
+			}
+
+			score := smartCropEdgeWeight*edge + smartCropSaturationWeight*saturation(r, g, b)
+			if isSkinTone(r, g, b) {
+				score += smartCropSkinWeight
+			}
+
+			rowSum += score
+			table.values[(y+1)*table.width+x+1] = table.values[y*table.width+x+1] + rowSum
+		}
+	}
+
+	return table
+}
+
+// hsv saturation of the color, 0..255
+func saturation(r uint8, g uint8, b uint8) int64 {
+	max, min := int64(r), int64(r)
+	for _, c := range []int64{int64(g), int64(b)} {
+		if c > max {
+			max = c
+		}
+		if c < min {
+			min = c
+		}
+	}
+	if max == 0 {
+		return 0
+	}
+	return (max - min) * 255 / max
+}
+
+// rough rgb skin tone rule
+func isSkinTone(r uint8, g uint8, b uint8) bool {
+	minGB := g
+	if b < minGB {
+		minGB = b
+	}
+	return r > 95 && g > 40 && b > 20 && r > g && r > b && r - minGB > 15
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// cache of downloaded source images.
+// entries keep the origin validators (ETag, Last-Modified) and freshness (Cache-Control, Expires),
+// fresh entries are used without contacting the origin, stale entries are revalidated with a conditional request.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// time the source was stored or last validated
+const sourceCacheDateHeader = "X-Source-Date"
+
+// origin headers kept with the source
+var sourceCacheHeaders = []string{"ETag", "Last-Modified", "Cache-Control", "Expires"}
+
+// download source through the cache, without cache the source is downloaded directly
+func fetchSource(cache *diskCache, source *sourceRequest, spoolPath string, threshold int64) (*sourceData, error) {
+	if cache == nil {
+		return downloadSource(source, spoolPath, threshold)
+	}
+
+	rawUrl := source.url
+	key := sourceCacheKey(source)
+	header, section, fp := cache.Open(key)
+	if fp != nil && isSourceFresh(header, time.Now()) {
+		return newCachedSource(header, section, fp), nil
+	}
+
+	req, err := source.newRequest()
+	if err == nil && fp != nil {
+		if etag := header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	var resp *http.Response
+	if err == nil {
+		resp, err = gServiceManager.fetcher.Do(req)
+	}
+	if err != nil {
+		if fp != nil {
+			fp.Close()
+		}
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	// not modified, the cached source is fresh again
+	if resp.StatusCode == http.StatusNotModified && fp != nil {
+		header = sourceCacheHeader(header, resp.Header)
+		if err := cache.PutReader(key, header, section); err != nil {
+			log.Println("Source cache error url: ", rawUrl, err)
+		}
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		return newCachedSource(header, section, fp), nil
+	}
+
+	if fp != nil {
+		fp.Close()
+	}
+
+	if err := gServiceManager.fetcher.checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	src, err := readSource(resp.Body, spoolPath, threshold)
+	if err != nil {
+		return nil, err
+	}
+	src.lastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	if resp.StatusCode == http.StatusOK && isSourceCacheable(resp.Header) {
+		if err := cache.PutReader(key, sourceCacheHeader(nil, resp.Header), src); err != nil {
+			log.Println("Source cache error url: ", rawUrl, err)
+		}
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			src.Close()
+			return nil, err
+		}
+	}
+
+	return src, nil
+}
+
+// cache key of the source: the normalized url, sources fetched with origin headers (credentials) are kept apart
+func sourceCacheKey(source *sourceRequest) string {
+	key := normalizeUrl(source.url)
+	if len(source.header) == 0 {
+		return key
+	}
+
+	names := []string{}
+	for name := range source.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name + ":" + strings.Join(source.header[name], ",") + "\n"))
+	}
+	return key + " " + hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// source read from the cache file
+func newCachedSource(header http.Header, section *io.SectionReader, fp *os.File) *sourceData {
+	src := &sourceData{ReadSeeker: section, cacheFile: fp}
+	src.lastModified, _ = http.ParseTime(header.Get("Last-Modified"))
+	return src
+}
+
+// header stored with the source: origin headers of the response, missing ones are kept from the stored header
+func sourceCacheHeader(stored http.Header, response http.Header) http.Header {
+	header := http.Header{}
+	for _, name := range sourceCacheHeaders {
+		if value := response.Get(name); value != "" {
+			header.Set(name, value)
+		} else if stored != nil && stored.Get(name) != "" {
+			header.Set(name, stored.Get(name))
+		}
+	}
+
+	header.Set(sourceCacheDateHeader, time.Now().UTC().Format(http.TimeFormat))
+	return header
+}
+
+// parse Cache-Control header into lower case directives and their values
+func cacheControlDirectives(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(value, ",") {
+		tokens := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if tokens[0] == "" {
+			continue
+		}
+
+		name := strings.ToLower(tokens[0])
+		directives[name] = ""
+		if len(tokens) == 2 {
+			directives[name] = strings.Trim(tokens[1], "\"")
+		}
+	}
+	return directives
+}
+
+// can response be cached: not forbidden, and can be revalidated or has a freshness lifetime
+func isSourceCacheable(header http.Header) bool {
+	directives := cacheControlDirectives(header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+
+	if header.Get("ETag") != "" || header.Get("Last-Modified") != "" {
+		return true
+	}
+
+	_, maxAge := directives["max-age"]
+	_, sharedMaxAge := directives["s-maxage"]
+	return maxAge || sharedMaxAge || header.Get("Expires") != ""
+}
+
+// is cached source fresh at now, stale sources must be revalidated
+func isSourceFresh(header http.Header, now time.Time) bool {
+	stored, err := http.ParseTime(header.Get(sourceCacheDateHeader))
+	if err != nil {
+		return false
+	}
+
+	directives := cacheControlDirectives(header.Get("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return false
+	}
+
+	// shared cache lifetime wins
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return false
+			}
+			return now.Sub(stored) < time.Duration(seconds) * time.Second
+		}
+	}
+
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		return err == nil && now.Before(expires)
+	}
+
+	return false
+}
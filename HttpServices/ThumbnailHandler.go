@@ -25,8 +25,14 @@ import (
 	"image"
 	"github.com/disintegration/imaging"
 	"image/color"
-	"os"
 	"io"
+	"strings"
+	"bytes"
+	"math"
+	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
 )
 
 // implements thumnail service handler
@@ -34,69 +40,394 @@ import (
 
 // thumbnail service parameters
 type thumbnailParameters struct {
-	width int // width of the new image
-	height int // height of the new image
+	width int // width of the new image, 0 to keep the source aspect ratio
+	height int // height of the new image, 0 to keep the source aspect ratio
 	url string // url of the image, used for downloading the image
-	tumbnailTmpPath string // full path of the image
+	tumbnailTmpPath string // full path of the spool file, used for big source images
 	fileName string // only the file name
 	tmpPath string // temporary path in which the files are saved
 	sessionId int // current session id
+	fit string // fit mode, how the image is placed in the requested size
+	gravity string // which part of the image is kept / where it is placed
+	background color.NRGBA // padding color
+	blurBackground bool // pad with a blurred copy of the image instead of a color
+	format string // requested output format, auto or empty for the source format
+	outputFormat string // resolved output format, after resize
+	accept string // client Accept header, used to negotiate auto format
+	sourceFormats []string // allowed source formats, empty allows all
+	sourceFormat string // detected source format, after download
+	jpeg jpegOptions // jpeg encoding options
+	keepMeta bool // keep source copyright metadata
+	exif *exifData // source metadata, after download
+	filter string // resampling filter name
+	dpr float64 // requested device pixel ratio, 0 when not requested
+	dprUpscale bool // device pixel ratio may make the thumbnail bigger than the source
+	dprUsed float64 // device pixel ratio used, after resize
+	maxWidth int // bounding width, 0 when not requested
+	maxHeight int // bounding height, 0 when not requested
+	upscale string // upscaling policy
+	maxSourcePixels int64 // maximum source image pixels
+	maxOutputWidth int // maximum thumbnail width
+	maxOutputHeight int // maximum thumbnail height
+	maxOutputPixels int64 // maximum thumbnail pixels
+	origin string // named origin, empty for url requests
+	originHeader http.Header // headers sent to the named origin
+	hosts *hostPolicy // permitted source hosts, nil permits all
+	sourceModified time.Time // source Last-Modified, zero when unknown
 }
+
+// supported fit modes
+const (
+	fitPad = "pad" // letterbox the whole image into the requested size
+	fitCover = "cover" // fill the requested size, crop the overflow
+	fitFill = "fill" // stretch to the requested size, ignore aspect ratio
+	fitInside = "inside" // shrink to fit the requested size, no canvas
+)
+
+// supported gravity values and their anchor on the canvas
+var gravityAnchors = map[string]imaging.Anchor{
+	"center": imaging.Center,
+	"north": imaging.Top,
+	"south": imaging.Bottom,
+	"east": imaging.Right,
+	"west": imaging.Left,
+	"northeast": imaging.TopRight,
+	"northwest": imaging.TopLeft,
+	"southeast": imaging.BottomRight,
+	"southwest": imaging.BottomLeft,
+}
+
+// supported resampling filters
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest": imaging.NearestNeighbor,
+	"box": imaging.Box,
+	"linear": imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"lanczos": imaging.Lanczos,
+	"mitchell": imaging.MitchellNetravali,
+}
+
+// default resampling filter
+const filterDefault = "lanczos"
+
+// upscaling policies
+const (
+	upscaleNever = "never" // the image is never enlarged, the output shrinks instead
+	upscaleAlways = "always" // the image is enlarged to the requested size
+	upscalePadOnly = "pad-only" // the image is never enlarged, the output is padded to the requested size
+	upscaleDefault = upscaleAlways
+)
+
+// default maximum source image pixels, 100 megapixels
+const maxSourcePixelsDefault = 100000000
+
+// default maximum thumbnail size, 8192 x 8192 and 40 megapixels
+const (
+	maxOutputSizeDefault = 8192
+	maxOutputPixelsDefault = 40000000
+)
+
+// default maximum device pixel ratio
+const dprDefaultMax = 3.0
+
+// content aware gravity, crops to the most interesting region (center when padding)
+const gravitySmart = "smart"
+
+// jpeg encoding defaults
+const (
+	jpegDefaultQuality = 95
+	jpegDefaultChroma = chromaSubsampling420
+)
+
+// padding background values
+const (
+	backgroundBlur = "blur" // blurred, scaled up copy of the image
+	backgroundDefault = "00000000" // transparent
+	backgroundBlurSize = 64 // blurred copy size, enlarged to the thumbnail size
+	backgroundBlurSigma = 3.0 // blur strength, in blurred copy pixels
+)
+
 // registration function
 func registerThumbnail(config *CommonServiceConfig) error {
-	http.HandleFunc(config.Path, thumbnailHandler)
+	// validate service defaults
+	if config.Background != "" {
+		if _, _, err := parseBackground(config.Background); err != nil {
+			return err
+		}
+	}
+
+	if err := validateOutputFormat(normalizeFormat(config.Format)); err != nil {
+		return err
+	}
+
+	if config.Quality != 0 && (config.Quality < 1 || config.Quality > 100) {
+		return errors.New("quality Not valid")
+	}
+
+	if config.Chroma != "" && isChromaSubsamplingValid(config.Chroma) == false {
+		return errors.New("chroma Not valid")
+	}
+
+	if config.Upscale != "" && isUpscaleValid(config.Upscale) == false {
+		return errors.New("upscale Not valid")
+	}
+
+	for _, host := range append(append([]string{}, config.AllowHosts...), config.DenyHosts...) {
+		if isHostPatternValid(host) == false {
+			return errors.New("host " + host + " Not valid")
+		}
+	}
+
+	for name, origin := range config.Origins {
+		if err := validateOrigin(name, origin); err != nil {
+			return err
+		}
+	}
+
+	if config.MaxSourcePixels < 0 {
+		return errors.New("maxsourcepixels Not valid")
+	}
+
+	if config.MaxOutputWidth < 0 || config.MaxOutputHeight < 0 || config.MaxOutputPixels < 0 {
+		return errors.New("maxoutput Not valid")
+	}
+
+	if config.MaxAge < 0 {
+		return errors.New("maxage Not valid")
+	}
+
+	if config.MaxDpr < 0 || math.IsNaN(config.MaxDpr) || math.IsInf(config.MaxDpr, 0) {
+		return errors.New("maxdpr Not valid")
+	}
+
+	if _, ok := resampleFilters[strings.ToLower(config.Filter)]; config.Filter != "" && ok == false {
+		return errors.New("filter Not valid")
+	}
+
+	for _, format := range config.SourceFormats {
+		if isSourceFormatValid(normalizeFormat(format)) == false {
+			return errors.New("source format " + format + " not supported")
+		}
+	}
+
+	http.HandleFunc(config.Path, func(w http.ResponseWriter, r *http.Request) {
+		thumbnailHandler(w, r, config)
+	})
 	return nil
 }
 
-// extract parameters from URL
-func fillThumbnailParams(values url.Values) (*thumbnailParameters, error){
+// extract parameters from URL, missing optional parameters are taken from the service configuration
+func fillThumbnailParams(values url.Values, config *CommonServiceConfig) (*thumbnailParameters, error){
 	var err error
+	var value string
 
 	params := thumbnailParameters{}
 
-	value := values.Get("url")
+	// source, client url or named origin path
+	if err := fillSourceParams(values, config, &params); err != nil {
+		return nil, err
+	}
+
+	// size, a missing dimension is resolved from the source aspect ratio
+	for _, dimension := range []struct {
+		name string
+		value *int
+	}{{"width", &params.width}, {"height", &params.height}, {"maxw", &params.maxWidth}, {"maxh", &params.maxHeight}} {
+		if *dimension.value, err = parseDimension(values, dimension.name); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.width == 0 && params.height == 0 && params.maxWidth == 0 && params.maxHeight == 0 {
+		log.Print("size parameters not exists")
+		return nil, errors.New("width or height not found")
+	}
+
+	// thumbnail size limits, requested sizes are checked now, resolved sizes before resizing
+	params.maxOutputWidth, params.maxOutputHeight, params.maxOutputPixels = config.MaxOutputWidth, config.MaxOutputHeight, config.MaxOutputPixels
+	if params.maxOutputWidth == 0 {
+		params.maxOutputWidth = maxOutputSizeDefault
+	}
+	if params.maxOutputHeight == 0 {
+		params.maxOutputHeight = maxOutputSizeDefault
+	}
+	if params.maxOutputPixels == 0 {
+		params.maxOutputPixels = maxOutputPixelsDefault
+	}
+
+	if params.width > params.maxOutputWidth || params.maxWidth > params.maxOutputWidth {
+		log.Print("width above the maximum")
+		return nil, errors.New("width above the maximum " + strconv.Itoa(params.maxOutputWidth))
+	}
+	if params.height > params.maxOutputHeight || params.maxHeight > params.maxOutputHeight {
+		log.Print("height above the maximum")
+		return nil, errors.New("height above the maximum " + strconv.Itoa(params.maxOutputHeight))
+	}
+
+	// device pixel ratio, capped by the service maximum
+	if value = values.Get("dpr"); value != "" {
+		params.dpr, err = strconv.ParseFloat(value, 64)
+		if err != nil || params.dpr <= 0 || math.IsNaN(params.dpr) || math.IsInf(params.dpr, 0) {
+			log.Print("dpr Not valid")
+			return nil, errors.New("dpr Not valid")
+		}
+
+		maxDpr := config.MaxDpr
+		if maxDpr == 0 {
+			maxDpr = dprDefaultMax
+		}
+		params.dpr = math.Min(params.dpr, math.Max(1, maxDpr))
+		params.dprUpscale = config.DprUpscale
+	}
+
+	value = values.Get("fit")
 
 	if value == "" {
-		log.Print("url parameter not exists")
-		return nil, errors.New("url not found")
+		value = fitPad
 	}
 
-	params.url = value
+	if isFitModeValid(value) == false {
+		log.Print("fit Not valid")
+		return nil, errors.New("fit Not valid")
+	}
+
+	params.fit = strings.ToLower(value)
 
-	value = values.Get("width")
+	value = values.Get("upscale")
+
+	if value == "" {
+		value = config.Upscale
+	}
 
 	if value == "" {
-		log.Print("width parameter not exists")
-		return nil, errors.New("width not found")
+		value = upscaleDefault
 	}
 
-	params.width, err = strconv.Atoi(value)
+	if isUpscaleValid(value) == false {
+		log.Print("upscale Not valid")
+		return nil, errors.New("upscale Not valid")
+	}
 
-	if err != nil {
-		log.Print("width Not valid")
-		return nil, errors.New("width Not valid")
+	params.upscale = strings.ToLower(value)
+
+	value = values.Get("gravity")
+
+	if value == "" {
+		value = "center"
 	}
 
-	value = values.Get("height")
+	if _, ok := gravityAnchors[strings.ToLower(value)]; ok == false && strings.ToLower(value) != gravitySmart {
+		log.Print("gravity Not valid")
+		return nil, errors.New("gravity Not valid")
+	}
+
+	params.gravity = strings.ToLower(value)
+
+	value = values.Get("filter")
 
 	if value == "" {
-		log.Print("height parameter not exists")
-		return nil, errors.New("height not found")
+		value = config.Filter
 	}
 
-	params.height, err = strconv.Atoi(value)
+	if value == "" {
+		value = filterDefault
+	}
+
+	if _, ok := resampleFilters[strings.ToLower(value)]; ok == false {
+		log.Print("filter Not valid")
+		return nil, errors.New("filter Not valid")
+	}
+
+	params.filter = strings.ToLower(value)
+
+	value = values.Get("bg")
+
+	if value == "" {
+		value = config.Background
+	}
+
+	if value == "" {
+		value = backgroundDefault
+	}
+
+	params.background, params.blurBackground, err = parseBackground(value)
 
 	if err != nil {
-		log.Print("height Not valid")
-		return nil, errors.New("height Not valid")
+		log.Print("bg Not valid")
+		return nil, errors.New("bg Not valid")
+	}
+
+	value = values.Get("format")
+
+	if value == "" {
+		value = config.Format
+	}
+
+	params.format = normalizeFormat(value)
+
+	if err := validateOutputFormat(params.format); err != nil {
+		log.Print("format Not valid")
+		return nil, err
 	}
 
 	//load needed params from handler's service
 	params.sessionId = gServiceManager.getSessionId()
 	params.tmpPath = gServiceManager.config.TempPath
 
+	params.sourceFormats = config.SourceFormats
+
+	params.maxSourcePixels = config.MaxSourcePixels
+	if params.maxSourcePixels == 0 {
+		params.maxSourcePixels = maxSourcePixelsDefault
+	}
+
+	// jpeg options
+	params.jpeg = jpegOptions{quality: config.Quality, progressive: config.Progressive, subsampling: config.Chroma}
+
+	if value = values.Get("q"); value != "" {
+		params.jpeg.quality, err = strconv.Atoi(value)
+		if err != nil || params.jpeg.quality < 1 || params.jpeg.quality > 100 {
+			log.Print("q Not valid")
+			return nil, errors.New("q Not valid")
+		}
+	}
+
+	if params.jpeg.quality == 0 {
+		params.jpeg.quality = jpegDefaultQuality
+	}
+
+	if value = values.Get("progressive"); value != "" {
+		params.jpeg.progressive, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Print("progressive Not valid")
+			return nil, errors.New("progressive Not valid")
+		}
+	}
+
+	if value = values.Get("chroma"); value != "" {
+		if isChromaSubsamplingValid(value) == false {
+			log.Print("chroma Not valid")
+			return nil, errors.New("chroma Not valid")
+		}
+		params.jpeg.subsampling = value
+	}
+
+	if params.jpeg.subsampling == "" {
+		params.jpeg.subsampling = jpegDefaultChroma
+	}
+
+	params.keepMeta = config.KeepMeta
+
+	if value = values.Get("keepmeta"); value != "" {
+		params.keepMeta, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Print("keepmeta Not valid")
+			return nil, errors.New("keepmeta Not valid")
+		}
+	}
+
 	// create file information
-	fileName, err := extractFileNameFromUrl(params.url)
+	fileName, err := fileNameFromUrl(params.url, config.CheckExtension)
 	if err != nil {
 		return nil, err
 	}
@@ -107,119 +438,671 @@ func fillThumbnailParams(values url.Values) (*thumbnailParameters, error){
 	return &params, nil
 }
 
-func thumbnailImageResize(params *thumbnailParameters) error{
+// resolve the source url: url parameter of a permitted host, or path of a named origin (src parameter)
+func fillSourceParams(values url.Values, config *CommonServiceConfig, params *thumbnailParameters) error {
+	if name := values.Get("src"); name != "" {
+		if values.Get("url") != "" {
+			log.Print("url and src parameters exist")
+			return errors.New("url and src are exclusive")
+		}
+
+		origin, ok := config.Origins[name]
+		if ok == false {
+			log.Print("src Not valid")
+			return errors.New("src " + name + " not found")
+		}
+
+		requestPath := values.Get("path")
+		if requestPath == "" {
+			log.Print("path parameter not exists")
+			return errors.New("path not found")
+		}
+
+		sourceUrl, err := originUrl(origin, requestPath)
+		if err != nil {
+			return errors.New("src " + name + " url Not valid")
+		}
+
+		// the origin headers and credentials never leave the origin host
+		if params.hosts, err = newOriginHostPolicy(config, origin); err != nil {
+			return errors.New("src " + name + " url Not valid")
+		}
+		u, _ := url.Parse(sourceUrl)
+		if params.hosts.isAllowed(u.Hostname()) == false {
+			log.Print("src host not allowed: ", u.Hostname())
+			return errors.New("host " + u.Hostname() + " not allowed")
+		}
+
+		params.url = sourceUrl
+		params.origin = name
+		params.originHeader = originHeader(origin)
+		return nil
+	}
+
+	value := values.Get("url")
+
+	if value == "" {
+		log.Print("url parameter not exists")
+		return errors.New("url not found")
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		log.Print("url Not valid")
+		return errors.New("url not valid")
+	}
+
+	params.hosts = newHostPolicy(config)
+	if params.hosts.isAllowed(u.Hostname()) == false {
+		log.Print("url host not allowed: ", u.Hostname())
+		return errors.New("host " + u.Hostname() + " not allowed")
+	}
+
+	params.url = value
+	return nil
+}
+
+// is upscaling policy valid/supported
+func isUpscaleValid(upscale string) bool {
+	for _, policy := range []string{upscaleNever, upscaleAlways, upscalePadOnly} {
+		if strings.ToLower(upscale) == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// parse optional positive dimension parameter, 0 when missing
+func parseDimension(values url.Values, name string) (int, error) {
+	value := values.Get(name)
+
+	if value == "" {
+		return 0, nil
+	}
+
+	dimension, err := strconv.Atoi(value)
+
+	if err != nil || dimension <= 0 {
+		log.Print(name + " Not valid")
+		return 0, errors.New(name + " Not valid")
+	}
+
+	return dimension, nil
+}
+
+// is fit mode valid/supported
+func isFitModeValid(fit string) bool {
+	for _, mode := range []string{fitPad, fitCover, fitFill, fitInside} {
+		if strings.ToLower(fit) == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// decode the source image and resize it, resolve the output format
+func thumbnailImageResize(src io.ReadSeeker, params *thumbnailParameters) (image.Image, error) {
+	srcImg, err := thumbnailDecode(src, params)
+	if err != nil {
+		return nil, err
+	}
+
+	dstFinalImg := thumbnailTransform(srcImg, params)
+
+	// resolve output format
+	switch params.format {
+	case formatAuto:
+		params.outputFormat = negotiateFormat(params.accept, dstFinalImg)
+	case formatSource:
+		params.outputFormat = outputFormatFor(params.sourceFormat, dstFinalImg)
+	default:
+		params.outputFormat = params.format
+	}
+
+	return dstFinalImg, nil
+}
+
+// encode the thumbnail in the output format
+func thumbnailEncode(w io.Writer, img image.Image, params *thumbnailParameters) error {
+	if params.outputFormat == "jpeg" {
+		return thumbnailEncodeJpeg(w, img, params)
+	}
+	return imaging.Encode(w, img, outputFormats[params.outputFormat].encoder)
+}
+
+// is chroma subsampling valid/supported
+func isChromaSubsamplingValid(chroma string) bool {
+	return chroma == chromaSubsampling420 || chroma == chromaSubsampling444
+}
+
+// validate output format value
+func validateOutputFormat(format string) error {
+	if isOutputFormatUnavailable(format) {
+		return errors.New("format " + format + " not available")
+	}
+
+	if isOutputFormatValid(format) == false {
+		return errors.New("format Not valid")
+	}
+
+	return nil
+}
+
+// parse background value, hex color (rgb, rgba, rrggbb or rrggbbaa with optional #) or blur
+func parseBackground(value string) (color.NRGBA, bool, error) {
+	if strings.ToLower(value) == backgroundBlur {
+		return color.NRGBA{}, true, nil
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+
+	// expand short form
+	if len(hex) == 3 || len(hex) == 4 {
+		expanded := ""
+		for _, c := range hex {
+			expanded += string(c) + string(c)
+		}
+		hex = expanded
+	}
+
+	// opaque by default
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	if len(hex) != 8 {
+		return color.NRGBA{}, false, errors.New("Background color not valid")
+	}
+
+	rgba, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, false, errors.New("Background color not valid")
+	}
+
+	return color.NRGBA{uint8(rgba >> 24), uint8(rgba >> 16), uint8(rgba >> 8), uint8(rgba)}, false, nil
+}
+
+// get the top left position of an image of the given size placed on the canvas
+func anchorPoint(canvasWidth int, canvasHeight int, width int, height int, anchor imaging.Anchor) image.Point {
+	x := (canvasWidth - width) / 2
+	y := (canvasHeight - height) / 2
+
+	switch anchor {
+	case imaging.TopLeft, imaging.Left, imaging.BottomLeft:
+		x = 0
+	case imaging.TopRight, imaging.Right, imaging.BottomRight:
+		x = canvasWidth - width
+	}
+
+	switch anchor {
+	case imaging.TopLeft, imaging.Top, imaging.TopRight:
+		y = 0
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		y = canvasHeight - height
+	}
+
+	return image.Pt(x, y)
+}
+
+// decode downloaded image, the format is detected by content and must be allowed
+func thumbnailDecode(src io.ReadSeeker, params *thumbnailParameters) (image.Image, error) {
+	// detect format, unless already probed
+	if params.sourceFormat == "" {
+		if _, err := thumbnailProbe(src, params); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	format := params.sourceFormat
+	params.exif = &exifData{}
+
+	// read metadata
+	if format == "jpeg" {
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		if params.exif, err = readExif(src); err != nil {
+			return nil, newServiceError(errorUnprocessable, err)
+		}
+	}
+
 	// decode image
-	srcImg, err := imaging.Open(params.tumbnailTmpPath)
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	srcImg, err := imaging.Decode(src)
 	if err != nil {
-		log.Println("Decode Error file: ", params.tumbnailTmpPath)
-		return errors.New("Decode Error file: " + params.tumbnailTmpPath)
-	}
-
-	// calculate size of original image
-	b:= srcImg.Bounds()
-	origHeight := b.Max.Y
-	origWidth := b.Max.X
-	origRatio := float64(origWidth) / float64(origHeight)
-	dstRatio := float64(params.width) / float64(params.height)
-	var dstWidth, dstHeight int
-
-	// in case aspect ratio is the same (rounded values)
-	if int(origRatio * 3.0) == int(dstRatio * 3.0) {
-		if origWidth < params.width {
-			dstHeight = origHeight
-			dstWidth = origWidth
-		} else {
-			dstHeight = params.height
-			dstWidth = params.width
+		log.Println("Decode Error url: ", params.url)
+		return nil, newServiceError(errorUnprocessable, errors.New("Decode Error " + format + " image"))
+	}
+
+	return applyOrientation(srcImg, params.exif.orientation), nil
+}
+
+// detect the source format and size from the image header, without decoding the image
+func thumbnailProbe(src io.ReadSeeker, params *thumbnailParameters) (image.Config, error) {
+	config, format, err := image.DecodeConfig(src)
+	if err != nil {
+		log.Println("Decode Error url: ", params.url)
+		return config, newServiceError(errorUnsupportedFormat, errors.New("Image format not recognized"))
+	}
+
+	if isSourceFormatAllowed(format, params.sourceFormats) == false {
+		log.Println("Source format not allowed: ", format)
+		return config, newServiceError(errorUnsupportedFormat, errors.New("Source format " + format + " not supported"))
+	}
+
+	params.sourceFormat = format
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// encode jpeg thumbnail, with the source copyright metadata when requested
+func thumbnailEncodeJpeg(w io.Writer, img image.Image, params *thumbnailParameters) error {
+	if params.keepMeta == false || params.exif == nil || len(params.exif.copyrightEntries()) == 0 {
+		return encodeJpeg(w, img, params.jpeg)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeJpeg(&buf, img, params.jpeg); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	if segment := buildExifSegment(params.exif.copyrightEntries()); segment != nil {
+		data = insertExifSegment(data, segment)
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// resolve thumbnail size in pixels, once the source size is known.
+// a missing dimension keeps the source aspect ratio (both missing is the source size),
+// the size is bounded by the maximum size, and scaled by the device pixel ratio.
+// the ratio does not make the thumbnail bigger than the source, unless upscaling is allowed
+func thumbnailSize(params *thumbnailParameters, srcWidth int, srcHeight int) (int, int) {
+	width := float64(params.width)
+	height := float64(params.height)
+	srcRatio := float64(srcWidth) / float64(srcHeight)
+
+	switch {
+	case width == 0 && height == 0:
+		width, height = float64(srcWidth), float64(srcHeight)
+	case width == 0:
+		width = height * srcRatio
+	case height == 0:
+		height = width / srcRatio
+	}
+
+	// bounding box, keeps the aspect ratio of the requested size
+	if params.maxWidth > 0 && width > float64(params.maxWidth) {
+		height = height * float64(params.maxWidth) / width
+		width = float64(params.maxWidth)
+	}
+
+	if params.maxHeight > 0 && height > float64(params.maxHeight) {
+		width = width * float64(params.maxHeight) / height
+		height = float64(params.maxHeight)
+	}
+
+	dpr := params.dpr
+	if dpr == 0 {
+		dpr = 1
+	}
+
+	if params.dprUpscale == false && dpr > 1 {
+		dpr = math.Min(dpr, math.Max(1, math.Min(float64(srcWidth) / width, float64(srcHeight) / height)))
+	}
+
+	params.dprUsed = dpr
+	return clampInt(int(width * dpr + 0.5), 1, math.MaxInt32), clampInt(int(height * dpr + 0.5), 1, math.MaxInt32)
+}
+
+// biggest thumbnail size of a source size, in both orientations (exif orientation is known after decoding)
+func thumbnailOutputSize(params *thumbnailParameters, srcWidth int, srcHeight int) (int, int) {
+	sizeParams := *params // thumbnailSize sets the used device pixel ratio
+	width, height := thumbnailSize(&sizeParams, srcWidth, srcHeight)
+	rotatedWidth, rotatedHeight := thumbnailSize(&sizeParams, srcHeight, srcWidth)
+	return maxInt(width, rotatedWidth), maxInt(height, rotatedHeight)
+}
+
+// resize the source image according to the fit mode and the upscaling policy
+func thumbnailTransform(srcImg image.Image, params *thumbnailParameters) image.Image {
+	anchor := gravityAnchors[params.gravity] // smart or unknown gravity is center
+	filter, ok := resampleFilters[params.filter]
+	if ok == false {
+		filter = resampleFilters[filterDefault]
+	}
+
+	srcWidth, srcHeight := srcImg.Bounds().Dx(), srcImg.Bounds().Dy()
+	width, height := thumbnailSize(params, srcWidth, srcHeight)
+	upscale := params.upscale
+	if upscale == "" {
+		upscale = upscaleDefault
+	}
+
+	var dstImg image.Image
+	switch params.fit {
+	case fitCover:
+		// crop to the requested aspect ratio, at source scale when not enlarged
+		cropWidth, cropHeight := width, height
+		if scale := math.Max(float64(width) / float64(srcWidth), float64(height) / float64(srcHeight)); scale > 1 {
+			switch upscale {
+			case upscaleNever:
+				cropWidth, cropHeight = scaledSize(width, height, 1 / scale)
+			case upscalePadOnly:
+				cropWidth, cropHeight = minInt(width, srcWidth), minInt(height, srcHeight)
+			}
 		}
-	} else { // aspect ratio is different
-		// pad left/right
-		if dstRatio > origRatio {
-			dstHeight = params.height
-			dstWidth = int(float64(params.height) * origRatio)
 
+		if params.gravity == gravitySmart {
+			dstImg = smartCrop(srcImg, cropWidth, cropHeight, filter)
+		} else {
+			dstImg = coverCrop(srcImg, cropWidth, cropHeight, anchor, filter)
+		}
+	case fitFill:
+		// stretch each dimension, up to the source size when not enlarged
+		if upscale == upscaleAlways {
+			dstImg = imaging.Resize(srcImg, width, height, filter)
 		} else {
-			// pad top/bottom
-			dstWidth = params.width
-			dstHeight = int(float64(params.width) / origRatio)
+			dstImg = imaging.Resize(srcImg, minInt(width, srcWidth), minInt(height, srcHeight), filter)
 		}
+	case fitInside:
+		// no canvas, pad only is never
+		scale := fitScale(srcWidth, srcHeight, width, height)
+		if upscale != upscaleAlways {
+			scale = math.Min(scale, 1)
+		}
+		dstWidth, dstHeight := scaledSize(srcWidth, srcHeight, scale)
+		return imaging.Resize(srcImg, dstWidth, dstHeight, filter)
+	default:
+		// letterbox, canvas scaled down with the image when not enlarged
+		scale := fitScale(srcWidth, srcHeight, width, height)
+		if scale > 1 && upscale != upscaleAlways {
+			if upscale == upscaleNever {
+				width, height = scaledSize(width, height, 1 / scale)
+				width, height = maxInt(width, srcWidth), maxInt(height, srcHeight)
+			}
+			scale = 1
+		}
+		dstWidth, dstHeight := scaledSize(srcWidth, srcHeight, scale)
+		dstImg = imaging.Resize(srcImg, minInt(dstWidth, width), minInt(dstHeight, height), filter)
+	}
+
+	if params.fit == fitPad || upscale == upscalePadOnly {
+		return thumbnailPad(srcImg, dstImg, width, height, params, anchor)
+	}
+	return dstImg
+}
+
+// crop the source to the aspect ratio of width x height at the anchor, and resize the crop.
+// the crop is computed in source coordinates, imaging.Fill would first resize sources smaller than
+// 100 pixels to cover the whole size (a 1x300 source covering 2000x2000 is resized to 2000x600000)
+func coverCrop(srcImg image.Image, width int, height int, anchor imaging.Anchor, filter imaging.ResampleFilter) image.Image {
+	cropWidth, cropHeight := coverCropSize(srcImg.Bounds().Dx(), srcImg.Bounds().Dy(), width, height)
+	return imaging.Resize(imaging.CropAnchor(srcImg, cropWidth, cropHeight, anchor), width, height, filter)
+}
+
+// size of the source region with the aspect ratio of width x height, covering as much of the source as possible
+func coverCropSize(srcWidth int, srcHeight int, width int, height int) (int, int) {
+	scale := math.Max(float64(width) / float64(srcWidth), float64(height) / float64(srcHeight))
+	return clampInt(int(float64(width) / scale + 0.5), 1, srcWidth), clampInt(int(float64(height) / scale + 0.5), 1, srcHeight)
+}
+
+// scale factor of the source size to fit inside the requested size
+func fitScale(srcWidth int, srcHeight int, width int, height int) float64 {
+	return math.Min(float64(width) / float64(srcWidth), float64(height) / float64(srcHeight))
+}
+
+// size multiplied by scale, rounded, at least one pixel
+func scaledSize(width int, height int, scale float64) (int, int) {
+	return maxInt(int(float64(width) * scale + 0.5), 1), maxInt(int(float64(height) * scale + 0.5), 1)
+}
+
+// blurred copy of the source covering width x height. the copy is blurred at backgroundBlurSize and enlarged,
+// the cost doesn't grow with the thumbnail size
+func blurBackdrop(srcImg image.Image, width int, height int) *image.NRGBA {
+	smallWidth, smallHeight := scaledSize(width, height, math.Min(1, backgroundBlurSize / float64(maxInt(width, height))))
+	smallImg := imaging.Blur(coverCrop(srcImg, smallWidth, smallHeight, imaging.Center, imaging.Linear), backgroundBlurSigma)
+	return imaging.Resize(smallImg, width, height, imaging.Linear)
+}
+
+// letterbox the resized image into a canvas of the requested size
+func thumbnailPad(srcImg image.Image, resizedImg image.Image, width int, height int, params *thumbnailParameters, anchor imaging.Anchor) image.Image {
+	if resizedImg.Bounds().Dx() == width && resizedImg.Bounds().Dy() == height {
+		return resizedImg // nothing to pad
 	}
 
-	// create background black image
-	dstFinalImg := imaging.New(params.width, params.height, color.NRGBA{0, 0, 0, 0})
-	resizedImg := imaging.Resize(srcImg, dstWidth, dstHeight, imaging.Lanczos)
+	// create background image
+	var dstFinalImg *image.NRGBA
+	if params.blurBackground {
+		dstFinalImg = blurBackdrop(srcImg, width, height)
+	} else {
+		dstFinalImg = imaging.New(width, height, params.background)
+	}
 
 	// merge images
-	dstFinalImg = imaging.Paste(dstFinalImg, resizedImg, image.Pt((params.width - dstWidth)/2 , (params.height - dstHeight)/2))
+	return imaging.Paste(dstFinalImg, resizedImg, anchorPoint(width, height, resizedImg.Bounds().Dx(), resizedImg.Bounds().Dy(), anchor))
+}
 
-	// save image back to file
-	err = imaging.Save(dstFinalImg, params.tumbnailTmpPath)
-	if err != nil {
-		log.Fatalf("Failed to save image: %v", err)
-		return err
+// cache key of the thumbnail: the normalized source url followed by every parameter which changes the response
+func thumbnailCacheKey(params *thumbnailParameters) string {
+	format := params.format
+	if format == formatAuto {
+		// the negotiated format depends only on the output formats accepted by the client
+		accepted := []string{}
+		for _, outputFormat := range []string{"jpeg", "png", "gif"} {
+			if isContentTypeAccepted(params.accept, outputFormats[outputFormat].contentType) {
+				accepted = append(accepted, outputFormat)
+			}
+		}
+		format += "(" + strings.Join(accepted, ",") + ")"
 	}
 
-	return nil
+	background := backgroundBlur
+	if params.blurBackground == false {
+		background = fmt.Sprintf("%02x%02x%02x%02x", params.background.R, params.background.G, params.background.B, params.background.A)
+	}
+
+	return normalizeUrl(params.url) + " " + fmt.Sprintf("w=%d h=%d maxw=%d maxh=%d dpr=%g dprupscale=%t fit=%s upscale=%s gravity=%s filter=%s bg=%s format=%s q=%d progressive=%t chroma=%s keepmeta=%t sourceformats=%s maxpixels=%d origin=%s name=%s",
+		params.width, params.height, params.maxWidth, params.maxHeight, params.dpr, params.dprUpscale,
+		params.fit, params.upscale, params.gravity, params.filter, background, format,
+		params.jpeg.quality, params.jpeg.progressive, params.jpeg.subsampling, params.keepMeta,
+		strings.ToLower(strings.Join(params.sourceFormats, ",")), params.maxSourcePixels, params.origin, params.fileName)
 }
 
-// upload resized file as a response
-func thumbnailUploadFile(params *thumbnailParameters, w http.ResponseWriter) error {
+// render the thumbnail response: headers and encoded image
+func thumbnailRender(params *thumbnailParameters, img image.Image) (*cacheEntry, error) {
+	header := http.Header{}
 
-	fp, err := os.Open(params.tumbnailTmpPath)
-	defer fp.Close() //Close after function return
-	if err != nil {
-		return errors.New("File Not Found")
+	// Content-Type of the output format
+	fileContentType := outputFormats[params.outputFormat].contentType
+
+	header.Set("Content-Disposition", "attachment; filename=" + fileNameWithFormat(params.fileName, params.outputFormat))
+	header.Set("Content-Type", fileContentType)
+	if params.format == formatAuto {
+		header.Add("Vary", "Accept") // response depends on the client accepted formats
+	}
+	if params.outputFormat == "jpeg" {
+		header.Set("X-Thumbnail-Quality", strconv.Itoa(params.jpeg.quality))
+	}
+	if params.dpr != 0 {
+		header.Set("Content-DPR", strconv.FormatFloat(params.dprUsed, 'g', 3, 64))
 	}
 
-	// fill header
+	var buf bytes.Buffer
+	if err := thumbnailEncode(&buf, img, params); err != nil {
+		return nil, errors.New("Image Encode Error")
+	}
 
-	//detect Content-Type of the file
-	fileHeader := make([]byte, 512)
-	fp.Read(fileHeader)
-	fileContentType := http.DetectContentType(fileHeader)
+	// validators, kept with the cached thumbnail
+	hash := sha256.Sum256(buf.Bytes())
+	header.Set("ETag", "\"" + hex.EncodeToString(hash[:16]) + "\"")
+	lastModified := params.sourceModified
+	if lastModified.IsZero() {
+		lastModified = time.Now()
+	}
+	header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
 
-	//get the file size
-	fileStat, _ := fp.Stat()                     //Get info from file
-	fileSize := strconv.FormatInt(fileStat.Size(), 10) //Get file size as a string
+	return &cacheEntry{header: header, data: buf.Bytes()}, nil
+}
 
+// Cache-Control header of the service, empty when not configured
+func thumbnailCacheControl(config *CommonServiceConfig) string {
+	if config.MaxAge <= 0 {
+		return ""
+	}
+
+	cacheControl := "public, max-age=" + strconv.Itoa(config.MaxAge)
+	if config.Immutable {
+		cacheControl += ", immutable"
+	}
+	return cacheControl
+}
+
+// upload the thumbnail to the browser, conditional requests (If-None-Match, If-Modified-Since) are answered with 304
+func thumbnailUpload(w http.ResponseWriter, r *http.Request, entry *cacheEntry, cacheControl string) {
 	//send the headers
-	w.Header().Set("Content-Disposition", "attachment; filename=" + params.fileName)
-	w.Header().Set("Content-Type", fileContentType)
-	w.Header().Set("Content-Length", fileSize)
+	for key, values := range entry.header {
+		w.Header()[key] = append([]string(nil), values...) // the entry is shared with other requests
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
 
-	//send the file
-	fp.Seek(0, 0) // return to the begining of the file
-	if _, err := io.Copy(w, fp); err != nil{ //'Copy' the file to the client
-		return errors.New("File Copy Error")
+	//send the image, Content-Length and conditional requests are handled by ServeContent
+	lastModified, _ := http.ParseTime(entry.header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(entry.data))
+}
+
+// download, resize and render the thumbnail, the rendered thumbnail is cached
+func thumbnailCompute(params *thumbnailParameters, key string, cached bool) *thumbnailResult {
+	// download image through the source cache, big images are spooled to a temporary file
+	source := &sourceRequest{url: params.url, header: params.originHeader, hosts: params.hosts}
+	src, err := fetchSource(gServiceManager.sourceCache, source, params.tumbnailTmpPath, gServiceManager.spoolThreshold())
+	if err != nil {
+		log.Println("Download Error url: ", params.url, err)
+		return &thumbnailResult{err: fetchError(err)}
 	}
+	defer src.Close() // dont forget to delete the spool file at the end of the session
+	params.sourceModified = src.lastModified
 
-	return nil
+	// source size, checked before the full decode
+	srcConfig, err := thumbnailProbe(src, params)
+	if err != nil {
+		return &thumbnailResult{err: err}
+	}
+
+	pixels := int64(srcConfig.Width) * int64(srcConfig.Height)
+	if pixels <= 0 {
+		log.Println("Image size Not valid url: ", params.url)
+		return &thumbnailResult{err: newServiceError(errorUnprocessable, errors.New("Image size Not valid"))}
+	}
+
+	if pixels > params.maxSourcePixels {
+		log.Printf("Image too large url: %s %dx%d", params.url, srcConfig.Width, srcConfig.Height)
+		details := map[string]interface{}{"width": srcConfig.Width, "height": srcConfig.Height, "max_pixels": params.maxSourcePixels}
+		return &thumbnailResult{err: newServiceErrorDetails(errorTooLarge, errors.New("Image too large"), details)}
+	}
+
+	// thumbnail size, checked before the canvas is allocated
+	outputWidth, outputHeight := thumbnailOutputSize(params, srcConfig.Width, srcConfig.Height)
+	outputPixels := int64(outputWidth) * int64(outputHeight)
+	if outputWidth > params.maxOutputWidth || outputHeight > params.maxOutputHeight || outputPixels > params.maxOutputPixels {
+		log.Printf("Thumbnail too large url: %s %dx%d", params.url, outputWidth, outputHeight)
+		details := map[string]interface{}{"width": outputWidth, "height": outputHeight,
+			"max_width": params.maxOutputWidth, "max_height": params.maxOutputHeight, "max_pixels": params.maxOutputPixels}
+		return &thumbnailResult{err: newServiceErrorDetails(errorTooLarge, errors.New("Thumbnail too large"), details)}
+	}
+
+	// decode and resize are limited by the worker pool and the pixel budget
+	if pool := gServiceManager.pool; pool != nil {
+		if err := pool.Acquire(); err != nil {
+			return &thumbnailResult{err: newServiceError(errorBusy, err)}
+		}
+		defer pool.Release()
+	}
+
+	// the source and the thumbnail are in memory together
+	pixels += outputPixels
+	if budget := gServiceManager.pixels; budget != nil {
+		if err := budget.Acquire(pixels); err == errPixelBudgetExceeded {
+			return &thumbnailResult{err: newServiceError(errorTooLarge, err)}
+		} else if err != nil {
+			return &thumbnailResult{err: newServiceError(errorBusy, err)}
+		}
+		defer budget.Release(pixels)
+	}
+
+	// resize image
+	dstImg, err := thumbnailImageResize(src, params)
+	if err != nil {
+		return &thumbnailResult{err: err}
+	}
+
+	entry, err := thumbnailRender(params, dstImg)
+	if err != nil {
+		return &thumbnailResult{err: err}
+	}
+
+	if cached {
+		if err := gServiceManager.cachePut(key, entry); err != nil {
+			log.Println("Cache Error url: ", params.url, err)
+		}
+	}
+
+	return &thumbnailResult{entry: entry}
 }
 
 // thumbnail service handler
-func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+func thumbnailHandler(w http.ResponseWriter, r *http.Request, config *CommonServiceConfig) {
 	// load client attributes, and internal information
-	params, err :=fillThumbnailParams(r.URL.Query())
+	params, err :=fillThumbnailParams(r.URL.Query(), config)
 	if err != nil {
-		http.Error(w, errorStringToJson(err.Error()), http.StatusMethodNotAllowed)
+		writeError(w, r, newServiceError(errorBadRequest, err))
 		return
 	}
+	params.accept = r.Header.Get("Accept")
 
-	// download image
-	if err := downloadFile(params.url, params.tumbnailTmpPath); err != nil {
-		http.Error(w, errorStringToJson(err.Error()), http.StatusNotFound)
-		return
+	// cached thumbnail, no download and decode needed
+	cached := gServiceManager.cacheEnabled()
+	key := thumbnailCacheKey(params)
+	if cached {
+		if entry := gServiceManager.cacheGet(key); entry != nil {
+			w.Header().Set("X-Cache", "HIT")
+			thumbnailUpload(w, r, entry, thumbnailCacheControl(config))
+			return
+		}
 	}
-	defer os.Remove(params.tumbnailTmpPath) // dont forget to delete file at the end of the session
 
-	// resize image
-	if err := thumbnailImageResize(params); err != nil {
-		http.Error(w, errorStringToJson(err.Error()), http.StatusInternalServerError)
+	// identical concurrent requests share one download and resize
+	result, _ := gServiceManager.flights.Do(key, func() *thumbnailResult {
+		return thumbnailCompute(params, key, cached)
+	})
+
+	if result.err != nil {
+		err := result.err
+		if errorKindOf(err) == errorBusy {
+			retryAfter := gServiceManager.retryAfter()
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			err = newServiceErrorDetails(errorBusy, err, map[string]interface{}{"retry_after": retryAfter}) // the result is shared, not modified
+		}
+		writeError(w, r, err)
 		return
 	}
 
-	// upload image to browser
-	if err := thumbnailUploadFile(params, w); err != nil {
-		http.Error(w, errorStringToJson(err.Error()), http.StatusInternalServerError)
+	if cached {
+		w.Header().Set("X-Cache", "MISS")
 	}
+
+	// upload image to browser
+	thumbnailUpload(w, r, result.entry, thumbnailCacheControl(config))
 }
@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Moshe Tubul
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package HttpServices
+
+// bounded worker pool and pixel budget for the CPU and memory heavy decode / resize.
+// requests wait for a worker in a bounded queue, they are rejected when the queue is full or the wait times out.
+// the pixel budget bounds the source pixels decoded at once, so many medium images can't exhaust the memory together
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// pool defaults
+const (
+	workerPoolDefaultQueueFactor = 4 // queue size per worker
+	workerPoolDefaultTimeout = 5 * time.Second
+	pixelBudgetDefault = 400000000 // 400 megapixels, about 1.6GB decoded
+)
+
+// no worker available
+var errPoolSaturated = errors.New("Server busy, try again later")
+
+// worker pool counters
+type workerPoolStats struct {
+	Workers int `json:"workers"`
+	Running int `json:"running"`
+	Queued int `json:"queued"` // current queue depth
+	QueueSize int `json:"queuesize"`
+	PeakQueued int `json:"peakqueued"` // maximum queue depth
+	Rejected uint64 `json:"rejected"` // queue full
+	TimedOut uint64 `json:"timedout"` // wait timed out
+}
+
+// worker pool, safe for concurrent use
+type workerPool struct {
+	slots chan struct{} // one item per running worker
+	queueSize int // maximum waiting requests
+	timeout time.Duration // maximum wait
+	mutex sync.Mutex // counters guard
+	queued int
+	peakQueued int
+	rejected uint64
+	timedOut uint64
+}
+
+// create worker pool
+func newWorkerPool(workers int, queueSize int, timeout time.Duration) *workerPool {
+	return &workerPool{slots: make(chan struct{}, workers), queueSize: queueSize, timeout: timeout}
+}
+
+// acquire a worker, waits in the queue up to the timeout. errPoolSaturated when no worker is available
+func (p *workerPool) Acquire() error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	p.mutex.Lock()
+	if p.queued >= p.queueSize {
+		p.rejected++
+		p.mutex.Unlock()
+		return errPoolSaturated
+	}
+	p.queued++
+	if p.queued > p.peakQueued {
+		p.peakQueued = p.queued
+	}
+	p.mutex.Unlock()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case p.slots <- struct{}{}:
+	case <-timer.C:
+		err = errPoolSaturated
+	}
+
+	p.mutex.Lock()
+	p.queued--
+	if err != nil {
+		p.timedOut++
+	}
+	p.mutex.Unlock()
+
+	return err
+}
+
+// release an acquired worker
+func (p *workerPool) Release() {
+	<-p.slots
+}
+
+// current counters
+func (p *workerPool) Stats() workerPoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return workerPoolStats{Workers: cap(p.slots), Running: len(p.slots), Queued: p.queued, QueueSize: p.queueSize,
+		PeakQueued: p.peakQueued, Rejected: p.rejected, TimedOut: p.timedOut}
+}
+
+// seconds a rejected client should wait before retrying, the wait timeout rounded up
+func retryAfterSeconds(timeout time.Duration) int {
+	seconds := int((timeout + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// image larger than the whole pixel budget
+var errPixelBudgetExceeded = errors.New("Image too large")
+
+// pixel budget counters
+type pixelBudgetStats struct {
+	Budget int64 `json:"budget"`
+	InUse int64 `json:"inuse"` // pixels of the images being processed
+	Waiting int `json:"waiting"`
+	TimedOut uint64 `json:"timedout"`
+}
+
+// global budget of source pixels being processed, safe for concurrent use
+type pixelBudget struct {
+	budget int64 // maximum pixels in flight
+	timeout time.Duration // maximum wait
+	mutex sync.Mutex // guard
+	inUse int64
+	waiting int
+	timedOut uint64
+	released chan struct{} // closed when pixels are released
+}
+
+// create pixel budget
+func newPixelBudget(budget int64, timeout time.Duration) *pixelBudget {
+	return &pixelBudget{budget: budget, timeout: timeout, released: make(chan struct{})}
+}
+
+// acquire pixels, waits for released pixels up to the timeout.
+// errPixelBudgetExceeded when the image never fits, errPoolSaturated on timeout
+func (p *pixelBudget) Acquire(pixels int64) error {
+	if pixels > p.budget {
+		return errPixelBudgetExceeded
+	}
+
+	var timer *time.Timer
+	p.mutex.Lock()
+	for p.inUse + pixels > p.budget {
+		if timer == nil {
+			timer = time.NewTimer(p.timeout)
+			defer timer.Stop()
+		}
+
+		released := p.released
+		p.waiting++
+		p.mutex.Unlock()
+
+		timedOut := false
+		select {
+		case <-released:
+		case <-timer.C:
+			timedOut = true
+		}
+
+		p.mutex.Lock()
+		p.waiting--
+		if timedOut {
+			p.timedOut++
+			p.mutex.Unlock()
+			return errPoolSaturated
+		}
+	}
+
+	p.inUse += pixels
+	p.mutex.Unlock()
+	return nil
+}
+
+// release acquired pixels
+func (p *pixelBudget) Release(pixels int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.inUse -= pixels
+	close(p.released) // wake up the waiting requests
+	p.released = make(chan struct{})
+}
+
+// current counters
+func (p *pixelBudget) Stats() pixelBudgetStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return pixelBudgetStats{Budget: p.budget, InUse: p.inUse, Waiting: p.waiting, TimedOut: p.timedOut}
+}
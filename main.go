@@ -50,5 +50,7 @@ func main(){
 		return
 	}
 
-	HttpServices.Init(path)
+	if err := HttpServices.Init(path); err != nil {
+		log.Fatal(err)
+	}
 }